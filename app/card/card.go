@@ -10,8 +10,11 @@ import (
 	"github.com/febriW/be-to-do/server"
 	"github.com/febriW/be-to-do/user"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -19,8 +22,47 @@ var (
 	ErrNotAuthorized = errors.New("not authorized")
 	ErrCantUpdate    = errors.New("can't update data that's already marked")
 	ErrCantDelete    = errors.New("can't delete data")
+	// ErrPreconditionRequired is returned for writes without If-Match.
+	ErrPreconditionRequired = errors.New("If-Match header required")
+	ErrVersionMismatch      = errors.New("card was changed since it was read")
+	ErrInvalidField         = errors.New("invalid field")
 )
 
+const (
+	// maxTitleLen is the width of the card.title column.
+	maxTitleLen = 100
+	// maxBodySize bounds the request bodies of card writes.
+	maxBodySize = 1 << 20
+)
+
+// FieldError describes why one field of a card was refused.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s: %s", ErrInvalidField, e.Field, e.Message)
+}
+
+func (e *FieldError) Unwrap() error {
+	return ErrInvalidField
+}
+
+// VersionError is returned when an If-Match doesn't name the current
+// version of a card. It carries the card as stored.
+type VersionError struct {
+	Current Card
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("card %s %s, current version is %d", e.Current.ActivitiesNo, ErrVersionMismatch, e.Current.Version)
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrVersionMismatch
+}
+
 type Card struct {
 	ActivitiesNo string `json:"activities_no"`
 	Title        string `json:"title"`
@@ -28,8 +70,20 @@ type Card struct {
 	AuthorId     int    `json:"author_id"`
 	MarkedStatus string `json:"marked_status"`
 	Marked       string `json:"marked"`
-	CreatedAt    string `json:"created_at"`
-	UpdatedAt    string `json:"updated_at"`
+	// StatusChangedAt is when the card last changed status.
+	StatusChangedAt string `json:"status_changed_at,omitempty"`
+	Version         int    `json:"version"`
+	CreatedAt       string `json:"created_at"`
+	UpdatedAt       string `json:"updated_at"`
+	DeletedAt       string `json:"deleted_at,omitempty"`
+
+	updatedAt time.Time
+}
+
+// ETag identifies the current version of the card for conditional
+// requests.
+func (c Card) ETag() string {
+	return `"` + strconv.Itoa(c.Version) + `"`
 }
 
 type CardParamCreate struct {
@@ -51,6 +105,8 @@ type CardParamUpdate struct {
 
 type CardsParam struct {
 	AuthorID int
+	// Deleted lists the trash instead of live cards.
+	Deleted bool
 	PaginationParam
 }
 
@@ -59,20 +115,71 @@ type PaginationParam struct {
 	Size int
 }
 
+type Config struct {
+	// NumberPrefix and NumberWidth shape activity numbers: "AC-" and 4 give
+	// AC-0001. Numbers past the width grow longer rather than wrap.
+	NumberPrefix string
+	NumberWidth  int
+	// NumberPerUser numbers each author's cards from 1. The author id is
+	// then part of the number, AC-12-0001, to keep numbers unique.
+	NumberPerUser bool
+	// MarkedEditable lets the title and content of marked cards change.
+	// Their status only changes by reopening them either way.
+	MarkedEditable bool
+}
+
 type Service struct {
-	db *sql.DB
+	db  *sql.DB
+	cfg Config
 }
 
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+func NewService(db *sql.DB, cfg Config) *Service {
+	return &Service{db: db, cfg: cfg}
+}
+
+// GetCard returns a card of the authenticated user, including a deleted
+// one. Admins, behind user.RequireRole, may read any author's card.
+func (s *Service) GetCard(ctx context.Context, activitiesNo string) (Card, error) {
+	repo := repository.New(s.db)
+
+	var c *repository.Card
+	if user.RoleFromContext(ctx) == user.RoleAdmin {
+		c = repo.CheckCardByNo(ctx, activitiesNo)
+	} else {
+		c = repo.CheckCard(ctx, activitiesNo, user.IDFromContext(ctx))
+	}
+	if c == nil {
+		return Card{}, fmt.Errorf("card %s %w", activitiesNo, ErrNotFound)
+	}
+	return mapCardRepoToService(*c), nil
+}
+
+func (s *Service) HandleGetCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := s.GetCard(r.Context(), r.PathValue("id"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		if server.NotModified(r, c.ETag(), c.updatedAt) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		server.JSONResponse(w, http.StatusOK, c)
+	}
 }
 
 func (s *Service) HandleDeleteCard() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		AuthorID := user.IDFromContext(r.Context())
 
-		err := s.DeleteCard(r.Context(), AuthorID, id)
+		err := s.DeleteCard(r.Context(), id)
 		if err != nil {
 			status := http.StatusInternalServerError
 			switch {
@@ -89,7 +196,9 @@ func (s *Service) HandleDeleteCard() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (s *Service) DeleteCard(ctx context.Context, AuthorID int, ActivitiesNo string) error {
+// DeleteCard deletes a card of the authenticated user.
+func (s *Service) DeleteCard(ctx context.Context, ActivitiesNo string) error {
+	AuthorID := user.IDFromContext(ctx)
 	err := s.execTx(ctx, func(r *repository.Repository) error {
 		if AuthorID <= 0 {
 			return fmt.Errorf("card with author id %s %w", strconv.Itoa(AuthorID), ErrNotFound)
@@ -100,7 +209,7 @@ func (s *Service) DeleteCard(ctx context.Context, AuthorID int, ActivitiesNo str
 		}
 
 		c := r.CheckCard(ctx, ActivitiesNo, AuthorID)
-		if c == nil {
+		if c == nil || c.DeletedAt != nil {
 			return fmt.Errorf("card %s from author id %v %w", ActivitiesNo, AuthorID, ErrNotFound)
 		}
 		if c.Marked != nil {
@@ -114,119 +223,255 @@ func (s *Service) DeleteCard(ctx context.Context, AuthorID int, ActivitiesNo str
 	return err
 }
 
-func (s *Service) UpdateCard(ctx context.Context, params CardParamUpdate) error {
+// UpdateCard updates a card of the authenticated user if ifMatch names its
+// current ETag, returning the updated card. A body author id naming anyone
+// else is refused with ErrNotAuthorized; a stale ifMatch with a
+// VersionError. An empty status keeps the current one, any other must be
+// an allowed transition.
+func (s *Service) UpdateCard(ctx context.Context, params CardParamUpdate, ifMatch string) (Card, error) {
+	authorID, err := ownAuthor(ctx, params.AuthorID)
+	if err != nil {
+		return Card{}, err
+	}
+	params.AuthorID = authorID
+
+	if params.AuthorID <= 0 {
+		return Card{}, fmt.Errorf("card with author id %s %w", strconv.Itoa(params.AuthorID), ErrNotFound)
+	}
+
+	if params.ActivitiesNo == "" {
+		return Card{}, fmt.Errorf("Card activities no %s %w", params.ActivitiesNo, ErrNotFound)
+	}
+
+	if params.Marked != "" {
+		return Card{}, ErrServerStamped
+	}
+
+	params.Title, err = checkTitle(params.Title)
+	if err != nil {
+		return Card{}, err
+	}
+
+	return s.updateCard(ctx, params.ActivitiesNo, params.AuthorID, ifMatch, func(r *repository.Repository, c *repository.Card) error {
+		c.Title = params.Title
+		c.Content = params.Content
+		if params.MarkedStatus == "" {
+			return nil
+		}
+
+		set, err := s.statusSet(ctx, r, c.AuthorID)
+		if err != nil {
+			return err
+		}
+		return set.setStatus(c, params.MarkedStatus, time.Now())
+	})
+}
+
+// updateCard is modifyCard for edits, which marked cards refuse unless
+// configured otherwise.
+func (s *Service) updateCard(ctx context.Context, activitiesNo string, authorID int, ifMatch string, apply func(*repository.Repository, *repository.Card) error) (Card, error) {
+	return s.modifyCard(ctx, activitiesNo, authorID, ifMatch, func(r *repository.Repository, c *repository.Card) error {
+		if c.Marked != nil && !s.cfg.MarkedEditable {
+			return fmt.Errorf("Card number %s %w", activitiesNo, ErrCantUpdate)
+		}
+		return apply(r, c)
+	})
+}
+
+// modifyCard locks a card of authorID, checks ifMatch against it, lets
+// apply change it and saves it, returning the card as stored afterwards.
+func (s *Service) modifyCard(ctx context.Context, activitiesNo string, authorID int, ifMatch string, apply func(*repository.Repository, *repository.Card) error) (Card, error) {
+	if ifMatch == "" {
+		return Card{}, ErrPreconditionRequired
+	}
+
+	var updated Card
 	err := s.execTx(ctx, func(r *repository.Repository) error {
-		if params.AuthorID <= 0 {
-			return fmt.Errorf("card with author id %s %w", strconv.Itoa(params.AuthorID), ErrNotFound)
+		r.ForUpdate = true
+		c := r.CheckCard(ctx, activitiesNo, authorID)
+		if c == nil || c.DeletedAt != nil {
+			return fmt.Errorf("card %s from author id %v %w", activitiesNo, authorID, ErrNotFound)
 		}
 
-		if params.ActivitiesNo == "" {
-			return fmt.Errorf("Card activities no %s %w", params.ActivitiesNo, ErrNotFound)
+		current := mapCardRepoToService(*c)
+		if !server.ETagListMatch(ifMatch, current.ETag(), true) {
+			return &VersionError{Current: current}
 		}
 
-		c := r.CheckCard(ctx, params.ActivitiesNo, params.AuthorID)
-		if c == nil {
-			return fmt.Errorf("card %s from author id %v %w", params.ActivitiesNo, params.AuthorID, ErrNotFound)
+		if err := apply(r, c); err != nil {
+			return err
 		}
 
-		if c.Marked != nil {
-			return fmt.Errorf("Card number %s %w", params.ActivitiesNo, ErrCantUpdate)
+		n, err := r.UpdateCard(ctx, *c)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return &VersionError{Current: current}
 		}
 
-		var markedTime *time.Time
-		if params.Marked != "" {
-			parsedTime, parseErr := time.Parse("2006-01-02 15:04:05", params.Marked)
-			if parseErr != nil {
-				return fmt.Errorf("invalid date format for Marked: %w", parseErr)
-			}
-			markedTime = &parsedTime
-		} else {
-			markedTime = nil
-		}
-
-		var markedStatus *string
-		if params.MarkedStatus != "" {
-			markedStatus = &params.MarkedStatus
-		} else {
-			markedStatus = nil
-		}
-
-		return r.UpdateCard(ctx, repository.Card{
-			ActivitiesNo: params.ActivitiesNo,
-			AuthorID:     params.AuthorID,
-			Title:        params.Title,
-			Content:      params.Content,
-			Marked:       markedTime,
-			MarkedStatus: markedStatus,
-		})
+		c = r.CheckCard(ctx, activitiesNo, authorID)
+		if c == nil {
+			return fmt.Errorf("card %s from author id %v %w", activitiesNo, authorID, ErrNotFound)
+		}
+		updated = mapCardRepoToService(*c)
+		return nil
 	})
 
-	return err
+	return updated, err
 }
 
 func (s *Service) HandleUpdateCard() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var params CardParamUpdate
 
-		err := json.NewDecoder(r.Body).Decode(&params)
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&params)
 		if err != nil {
-			server.ErrorResponse(w, http.StatusBadRequest, err)
+			server.ErrorResponse(w, readErrorStatus(err), err)
 			return
 		}
 
-		err = s.UpdateCard(r.Context(), params)
+		c, err := s.UpdateCard(r.Context(), params, r.Header.Get("If-Match"))
 		if err != nil {
-			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			updateErrorResponse(w, err)
 			return
 		}
 
+		server.SetValidators(w, c.ETag(), c.updatedAt)
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func (s *Service) CreateCard(ctx context.Context, params CardParamCreate) error {
-	err := s.execTx(ctx, func(r *repository.Repository) error {
+// updateErrorResponse writes the response for a failed card update. A
+// version conflict answers 412 with the card as stored, so the client can
+// merge and retry with its ETag.
+func updateErrorResponse(w http.ResponseWriter, err error) {
+	var conflict *VersionError
+	if errors.As(err, &conflict) {
+		server.SetValidators(w, conflict.Current.ETag(), conflict.Current.updatedAt)
+		output := struct {
+			Error   string `json:"error"`
+			Current Card   `json:"current"`
+		}{
+			Error:   conflict.Error(),
+			Current: conflict.Current,
+		}
+		server.JSONResponse(w, http.StatusPreconditionFailed, output)
+		return
+	}
+
+	status := http.StatusUnprocessableEntity
+	switch {
+	case errors.Is(err, ErrNotAuthorized):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrPreconditionRequired):
+		status = http.StatusPreconditionRequired
+	case errors.Is(err, ErrInvalidTransition):
+		status = http.StatusConflict
+	}
+	server.ErrorResponse(w, status, err)
+}
+
+// CreateCard creates a card owned by the authenticated user and returns it.
+// A body author id naming anyone else is refused with ErrNotAuthorized.
+// The card starts in todo unless another status is given.
+func (s *Service) CreateCard(ctx context.Context, params CardParamCreate) (Card, error) {
+	authorID, err := ownAuthor(ctx, params.AuthorID)
+	if err != nil {
+		return Card{}, err
+	}
+	params.AuthorID = authorID
+
+	var created Card
+	err = s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
 		if params.AuthorID <= 0 {
 			return fmt.Errorf("author id %s %w", strconv.Itoa(params.AuthorID), ErrNotFound)
 		}
-		var markedTime *time.Time
 		if params.Marked != "" {
-			parsedTime, parseErr := time.Parse("2006-01-02 15:04:05", params.Marked)
-			if parseErr != nil {
-				return fmt.Errorf("invalid date format for Marked: %w", parseErr)
-			}
-			markedTime = &parsedTime
-		} else {
-			markedTime = nil
+			return ErrServerStamped
 		}
 
-		return r.CreateCard(ctx, repository.Card{
+		title, err := checkTitle(params.Title)
+		if err != nil {
+			return err
+		}
+
+		status := params.MarkedStatus
+		if status == "" {
+			status = StatusTodo
+		}
+		card := repository.Card{
 			AuthorID: params.AuthorID,
-			Title:    params.Title,
+			Title:    title,
 			Content:  params.Content,
-			Marked:   markedTime,
-		})
+		}
+		set, err := s.statusSet(ctx, r, params.AuthorID)
+		if err != nil {
+			return err
+		}
+		if err := set.setStatus(&card, status, time.Now()); err != nil {
+			return err
+		}
+
+		card.ActivitiesNo, err = s.nextActivitiesNo(ctx, r, params.AuthorID)
+		if err != nil {
+			return err
+		}
+
+		c, err := r.CreateCard(ctx, card)
+		if err != nil {
+			return err
+		}
+		created = mapCardRepoToService(c)
+		return nil
 	})
 
-	return err
+	return created, err
+}
+
+// nextActivitiesNo takes the next activity number for a card of authorID.
+// The counter stays locked until r's transaction ends, so concurrent
+// creates wait for each other instead of taking the same number.
+func (s *Service) nextActivitiesNo(ctx context.Context, r *repository.Repository, authorID int) (string, error) {
+	prefix := s.cfg.NumberPrefix
+	scope := "card"
+	if s.cfg.NumberPerUser {
+		prefix += strconv.Itoa(authorID) + "-"
+		scope += ":" + strconv.Itoa(authorID)
+	}
+
+	n, err := r.NextSequence(ctx, scope, prefix)
+	if err != nil {
+		return "", fmt.Errorf("error when numbering card: %w", err)
+	}
+	return fmt.Sprintf("%s%0*d", prefix, s.cfg.NumberWidth, n), nil
 }
 
 func (s *Service) HandleCreateCard() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var input CardParamCreate
-		err := json.NewDecoder(r.Body).Decode(&input)
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&input)
 		if err != nil {
-			server.ErrorResponse(w, http.StatusBadRequest, err)
+			server.ErrorResponse(w, readErrorStatus(err), err)
 			return
 		}
 
-		err = s.CreateCard(r.Context(), input)
+		c, err := s.CreateCard(r.Context(), input)
 		if err != nil {
-			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, ErrNotAuthorized) {
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Location", "/card/"+url.PathEscape(c.ActivitiesNo))
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		server.JSONResponse(w, http.StatusCreated, c)
 	}
 }
 
@@ -234,6 +479,7 @@ func (s *Service) GetAllCards(ctx context.Context, param CardsParam) ([]Card, in
 	repo := repository.New(s.db)
 	repoParam := repository.CardsParam{
 		AuthorID: param.AuthorID,
+		Deleted:  param.Deleted,
 	}
 	repoParam.Page = param.Page
 	repoParam.Size = param.Size
@@ -247,6 +493,15 @@ func (s *Service) GetAllCards(ctx context.Context, param CardsParam) ([]Card, in
 }
 
 func (s *Service) HandleGetAllCards() func(http.ResponseWriter, *http.Request) {
+	return s.handleListCards(false)
+}
+
+// HandleGetTrash lists deleted cards, most recently deleted first.
+func (s *Service) HandleGetTrash() func(http.ResponseWriter, *http.Request) {
+	return s.handleListCards(true)
+}
+
+func (s *Service) handleListCards(deleted bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		urlParams := r.URL.Query()
 		var errs []error
@@ -286,8 +541,15 @@ func (s *Service) HandleGetAllCards() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
+		authorID, err := visibleAuthor(r.Context(), authorID)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusForbidden, err)
+			return
+		}
+
 		params := CardsParam{
 			AuthorID: authorID,
+			Deleted:  deleted,
 			PaginationParam: PaginationParam{
 				Page: page,
 				Size: size,
@@ -306,21 +568,58 @@ func (s *Service) HandleGetAllCards() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (s *Service) execTx(ctx context.Context, fn func(*repository.Repository) error) error {
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+// checkTitle trims a card title and checks that it is set and fits.
+func checkTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	switch {
+	case title == "":
+		return "", &FieldError{Field: "title", Message: "can't be empty"}
+	case utf8.RuneCountInString(title) > maxTitleLen:
+		return "", &FieldError{Field: "title", Message: fmt.Sprintf("must be at most %d characters", maxTitleLen)}
 	}
-	repo := repository.New(tx)
-	err = fn(repo)
-	if err != nil {
-		if rbErr := tx.Rollback(); rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
-		}
-		return err
+	return title, nil
+}
+
+// readErrorStatus is the status for a request body that couldn't be read.
+func readErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
 	}
+	return http.StatusBadRequest
+}
 
-	return tx.Commit()
+// ownAuthor returns the authenticated user as the author of a write. Clients
+// may still send author_id, but only their own.
+func ownAuthor(ctx context.Context, requested int) (int, error) {
+	self := user.IDFromContext(ctx)
+	if requested != 0 && requested != self {
+		return 0, fmt.Errorf("writing as author id %d %w", requested, ErrNotAuthorized)
+	}
+	return self, nil
+}
+
+// visibleAuthor returns whose cards a listing for requested may show:
+//   - users see their own cards, whether or not they name themselves;
+//   - naming another author is refused with ErrNotAuthorized;
+//   - admins may name any author, and see every author's cards when they
+//     name none. Admin status comes from user.RequireRole, so it only
+//     applies on routes behind it.
+//
+// Deleted cards are never listed.
+func visibleAuthor(ctx context.Context, requested int) (int, error) {
+	self := user.IDFromContext(ctx)
+	if user.RoleFromContext(ctx) == user.RoleAdmin {
+		return requested, nil
+	}
+	if requested != 0 && requested != self {
+		return 0, fmt.Errorf("cards of author id %d %w", requested, ErrNotAuthorized)
+	}
+	return self, nil
+}
+
+func (s *Service) execTx(ctx context.Context, fn func(*repository.Repository) error) error {
+	return repository.ExecTx(ctx, s.db, fn)
 }
 
 func mapCardRepoToService(data repository.Card) Card {
@@ -331,21 +630,28 @@ func mapCardRepoToService(data repository.Card) Card {
 		marked = ""
 	}
 
-	var markedStatus string
-	if data.MarkedStatus != nil && *data.MarkedStatus != "" {
-		markedStatus = *data.MarkedStatus
-	} else {
-		markedStatus = ""
+	var statusChangedAt string
+	if data.StatusChangedAt != nil {
+		statusChangedAt = data.StatusChangedAt.Format(time.DateTime)
+	}
+
+	var deletedAt string
+	if data.DeletedAt != nil {
+		deletedAt = data.DeletedAt.Format(time.DateTime)
 	}
 
 	return Card{
-		ActivitiesNo: data.ActivitiesNo,
-		AuthorId:     data.AuthorID,
-		Title:        data.Title,
-		Content:      data.Content,
-		CreatedAt:    data.CreatedAt.Format(time.DateTime),
-		UpdatedAt:    data.UpdatedAt.Format(time.DateTime),
-		Marked:       marked,
-		MarkedStatus: markedStatus,
+		ActivitiesNo:    data.ActivitiesNo,
+		AuthorId:        data.AuthorID,
+		Title:           data.Title,
+		Content:         data.Content,
+		CreatedAt:       data.CreatedAt.Format(time.DateTime),
+		UpdatedAt:       data.UpdatedAt.Format(time.DateTime),
+		Marked:          marked,
+		MarkedStatus:    cardStatus(&data),
+		StatusChangedAt: statusChangedAt,
+		Version:         data.Version,
+		DeletedAt:       deletedAt,
+		updatedAt:       data.UpdatedAt,
 	}
 }
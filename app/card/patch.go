@@ -0,0 +1,178 @@
+package card
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/user"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// MergePatchType is the media type of RFC 7396 JSON Merge Patch documents.
+const MergePatchType = "application/merge-patch+json"
+
+var ErrInvalidPatch = errors.New("invalid merge patch")
+
+// readOnlyFields are card fields a patch may not set.
+var readOnlyFields = map[string]bool{
+	"activities_no":     true,
+	"author_id":         true,
+	"marked":            true,
+	"status_changed_at": true,
+	"version":           true,
+	"created_at":        true,
+	"updated_at":        true,
+	"deleted_at":        true,
+}
+
+// cardPatch is a validated merge patch.
+type cardPatch struct {
+	edits []func(*repository.Card)
+	// status is the status to move to, nil to keep the current one.
+	status *string
+}
+
+// PatchCard applies a JSON Merge Patch to a card of the authenticated user
+// if ifMatch names its current ETag. Members left out of the patch are
+// kept; a marked_status must be an allowed transition. Every refused field
+// is reported.
+func (s *Service) PatchCard(ctx context.Context, activitiesNo string, patch []byte, ifMatch string) (Card, error) {
+	p, err := parsePatch(patch)
+	if err != nil {
+		return Card{}, err
+	}
+
+	return s.updateCard(ctx, activitiesNo, user.IDFromContext(ctx), ifMatch, func(r *repository.Repository, c *repository.Card) error {
+		for _, edit := range p.edits {
+			edit(c)
+		}
+		if p.status == nil {
+			return nil
+		}
+
+		set, err := s.statusSet(ctx, r, c.AuthorID)
+		if err != nil {
+			return err
+		}
+		return set.setStatus(c, *p.status, time.Now())
+	})
+}
+
+// parsePatch validates a merge patch.
+func parsePatch(patch []byte) (cardPatch, error) {
+	var members map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	if err := dec.Decode(&members); err != nil || members == nil {
+		return cardPatch{}, fmt.Errorf("%w: must be a JSON object", ErrInvalidPatch)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return cardPatch{}, fmt.Errorf("%w: trailing data after the object", ErrInvalidPatch)
+	}
+
+	// Report fields in a stable order.
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var p cardPatch
+	var errs []error
+	for _, name := range names {
+		raw := members[name]
+		isNull := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+
+		switch {
+		case name == "title":
+			v, err := patchString(raw, isNull)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: name, Message: err.Error()})
+				continue
+			}
+			v, err = checkTitle(v)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			p.edits = append(p.edits, func(c *repository.Card) { c.Title = v })
+
+		case name == "content":
+			v, err := patchString(raw, isNull)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: name, Message: err.Error()})
+				continue
+			}
+			p.edits = append(p.edits, func(c *repository.Card) { c.Content = v })
+
+		case name == "marked_status":
+			v, err := patchString(raw, isNull)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: name, Message: err.Error()})
+				continue
+			}
+			p.status = &v
+
+		case readOnlyFields[name]:
+			errs = append(errs, &FieldError{Field: name, Message: "is read-only"})
+
+		default:
+			errs = append(errs, &FieldError{Field: name, Message: "unknown field"})
+		}
+	}
+	if len(errs) > 0 {
+		return cardPatch{}, errors.Join(errs...)
+	}
+	return p, nil
+}
+
+// patchString decodes a patch member that must be a string.
+func patchString(raw json.RawMessage, isNull bool) (string, error) {
+	if isNull {
+		return "", errors.New("can't be null")
+	}
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", errors.New("must be a string")
+	}
+	return v, nil
+}
+
+func (s *Service) HandlePatchCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mt, _, err := mime.ParseMediaType(ct)
+			if err != nil || (mt != MergePatchType && mt != "application/json") {
+				w.Header().Set("Accept-Patch", MergePatchType)
+				server.ErrorResponse(w, http.StatusUnsupportedMediaType, fmt.Errorf("content type %q not supported, use %s", ct, MergePatchType))
+				return
+			}
+		}
+
+		patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			server.ErrorResponse(w, readErrorStatus(err), err)
+			return
+		}
+
+		c, err := s.PatchCard(r.Context(), r.PathValue("id"), patch, r.Header.Get("If-Match"))
+		if err != nil {
+			if errors.Is(err, ErrInvalidPatch) {
+				server.ErrorResponse(w, http.StatusBadRequest, err)
+				return
+			}
+			updateErrorResponse(w, err)
+			return
+		}
+
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		server.JSONResponse(w, http.StatusOK, c)
+	}
+}
@@ -0,0 +1,113 @@
+package card
+
+import (
+	"errors"
+	"github.com/febriW/be-to-do/user"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePatchTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		err   bool
+	}{
+		{name: "title", patch: `{"title": " New title "}`},
+		{name: "empty title", patch: `{"title": "  "}`, err: true},
+		{name: "long title", patch: `{"title": "` + strings.Repeat("é", maxTitleLen+1) + `"}`, err: true},
+		{name: "null title", patch: `{"title": null}`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePatch([]byte(tt.patch))
+			if tt.err != errors.Is(err, ErrInvalidField) {
+				t.Fatalf("err %v, want invalid field %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCardWritesRefuseLargeBodies(t *testing.T) {
+	body := `{"title": "title", "content": "` + strings.Repeat("a", maxBodySize) + `"}`
+
+	tests := []struct {
+		name    string
+		method  string
+		handler func(*Service) func(http.ResponseWriter, *http.Request)
+	}{
+		{name: "create", method: http.MethodPost, handler: (*Service).HandleCreateCard},
+		{name: "update", method: http.MethodPut, handler: (*Service).HandleUpdateCard},
+		{name: "patch", method: http.MethodPatch, handler: (*Service).HandlePatchCard},
+		{name: "transition", method: http.MethodPost, handler: (*Service).HandleTransitionCard},
+		{name: "reopen", method: http.MethodPost, handler: (*Service).HandleReopenCard},
+		{name: "create status", method: http.MethodPost, handler: (*Service).HandleCreateStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+
+			req := httptest.NewRequest(tt.method, "/card/AC-0001", strings.NewReader(body))
+			req.SetPathValue("id", "AC-0001")
+			req.Header.Set("If-Match", `"1"`)
+			req = req.WithContext(user.NewContext(req.Context(), 5, ""))
+			rec := httptest.NewRecorder()
+			tt.handler(s)(rec, req)
+
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCardWritesValidateTitle(t *testing.T) {
+	titles := map[string]string{
+		"empty title": `"  "`,
+		"long title":  `"` + strings.Repeat("a", maxTitleLen+1) + `"`,
+	}
+
+	for name, title := range titles {
+		t.Run(name+" on create", func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+			mock.ExpectBegin()
+			mock.ExpectRollback()
+
+			req := httptest.NewRequest(http.MethodPost, "/card", strings.NewReader(`{"title": `+title+`}`))
+			req = req.WithContext(user.NewContext(req.Context(), 5, ""))
+			rec := httptest.NewRecorder()
+			s.HandleCreateCard()(rec, req)
+
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run(name+" on update", func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+
+			req := httptest.NewRequest(http.MethodPut, "/card", strings.NewReader(`{"activities_no": "AC-0001", "title": `+title+`}`))
+			req.Header.Set("If-Match", `"1"`)
+			req = req.WithContext(user.NewContext(req.Context(), 5, ""))
+			rec := httptest.NewRecorder()
+			s.HandleUpdateCard()(rec, req)
+
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package card
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/user"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxReopenReasonLen bounds the reason given for reopening a card.
+const maxReopenReasonLen = 500
+
+var (
+	ErrNotMarked     = errors.New("card is not marked")
+	ErrReasonMissing = errors.New("a reason is required")
+)
+
+// Reopen is one entry of the reopen audit trail of a card.
+type Reopen struct {
+	ReopenedBy int    `json:"reopened_by"`
+	Reason     string `json:"reason"`
+	FromStatus string `json:"from_status"`
+	ToStatus   string `json:"to_status"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// ReopenCard clears the mark of a card of the authenticated user, moving it
+// from its final status to status, todo if empty, and records who did it
+// and why. ifMatch is optional; when given it must name the current ETag.
+func (s *Service) ReopenCard(ctx context.Context, activitiesNo, status, reason, ifMatch string) (Card, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return Card{}, ErrReasonMissing
+	}
+	if utf8.RuneCountInString(reason) > maxReopenReasonLen {
+		return Card{}, fmt.Errorf("%w: reason must be at most %d characters", ErrInvalidField, maxReopenReasonLen)
+	}
+	if status == "" {
+		status = StatusTodo
+	}
+	if ifMatch == "" {
+		ifMatch = "*"
+	}
+
+	userID := user.IDFromContext(ctx)
+	return s.modifyCard(ctx, activitiesNo, userID, ifMatch, func(r *repository.Repository, c *repository.Card) error {
+		if c.Marked == nil {
+			return fmt.Errorf("card %s: %w", activitiesNo, ErrNotMarked)
+		}
+
+		set, err := s.statusSet(ctx, r, c.AuthorID)
+		if err != nil {
+			return err
+		}
+		base, ok := set[status]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownStatus, status)
+		}
+		if isFinal(base) {
+			return fmt.Errorf("%w: can't reopen to final status %s", ErrInvalidTransition, status)
+		}
+
+		from := cardStatus(c)
+		now := time.Now()
+		c.MarkedStatus = &status
+		c.StatusChangedAt = &now
+		c.Marked = nil
+
+		return r.CreateCardReopen(ctx, repository.CardReopen{
+			ActivitiesNo: activitiesNo,
+			ReopenedBy:   userID,
+			Reason:       reason,
+			FromStatus:   from,
+			ToStatus:     status,
+		})
+	})
+}
+
+// GetReopens returns the reopen audit trail of a card of the authenticated
+// user, oldest first.
+func (s *Service) GetReopens(ctx context.Context, activitiesNo string) ([]Reopen, error) {
+	repo := repository.New(s.db)
+	if repo.CheckCard(ctx, activitiesNo, user.IDFromContext(ctx)) == nil {
+		return nil, fmt.Errorf("card %s %w", activitiesNo, ErrNotFound)
+	}
+
+	rs, err := repo.GetCardReopens(ctx, activitiesNo)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Reopen, 0, len(rs))
+	for _, r := range rs {
+		res = append(res, Reopen{
+			ReopenedBy: r.ReopenedBy,
+			Reason:     r.Reason,
+			FromStatus: r.FromStatus,
+			ToStatus:   r.ToStatus,
+			CreatedAt:  r.CreatedAt.Format(time.DateTime),
+		})
+	}
+	return res, nil
+}
+
+func (s *Service) HandleReopenCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Reason string `json:"reason"`
+			Status string `json:"status"`
+		}
+
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, readErrorStatus(err), err)
+			return
+		}
+
+		c, err := s.ReopenCard(r.Context(), r.PathValue("id"), input.Status, input.Reason, r.Header.Get("If-Match"))
+		if err != nil {
+			if errors.Is(err, ErrNotMarked) {
+				server.ErrorResponse(w, http.StatusConflict, err)
+				return
+			}
+			updateErrorResponse(w, err)
+			return
+		}
+
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		server.JSONResponse(w, http.StatusOK, c)
+	}
+}
+
+func (s *Service) HandleGetReopens() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs, err := s.GetReopens(r.Context(), r.PathValue("id"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			Total int
+			Data  []Reopen
+		}{
+			Total: len(rs),
+			Data:  rs,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
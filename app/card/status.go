@@ -0,0 +1,312 @@
+package card
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/user"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Built-in statuses. Every card is in one of these or in a custom status
+// of its author, which behaves like the built-in status it is based on.
+const (
+	StatusTodo       = "todo"
+	StatusInProgress = "in_progress"
+	StatusDone       = "done"
+	StatusCancelled  = "cancelled"
+)
+
+// maxCustomStatuses caps the custom statuses of one user.
+const maxCustomStatuses = 20
+
+// transitions lists the statuses each built-in status may move to. Done
+// and cancelled are final: reaching them marks the card.
+var transitions = map[string][]string{
+	StatusTodo:       {StatusInProgress, StatusDone, StatusCancelled},
+	StatusInProgress: {StatusTodo, StatusDone, StatusCancelled},
+	StatusDone:       nil,
+	StatusCancelled:  nil,
+}
+
+// statusNamePattern matches names of custom statuses. They must fit the
+// card.marked_status column.
+var statusNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+var (
+	ErrUnknownStatus     = errors.New("unknown status")
+	ErrInvalidTransition = errors.New("status transition not allowed")
+	ErrServerStamped     = errors.New("marked is set by the server, change the status instead")
+	ErrStatusExists      = errors.New("status already exists")
+	ErrStatusInUse       = errors.New("status is used by cards")
+	ErrInvalidStatus     = errors.New("invalid status")
+)
+
+type Status struct {
+	Name string `json:"name"`
+	// Base is the built-in status a custom status behaves like. It equals
+	// Name for built-in statuses.
+	Base   string `json:"base"`
+	Custom bool   `json:"custom"`
+	Final  bool   `json:"final"`
+}
+
+// statusSet maps the status names available to a user to their base.
+type statusSet map[string]string
+
+// statusSet returns the statuses of userID. Callers about to move a card set
+// r.ForUpdate, so that the custom statuses stay locked until the card is
+// saved and DeleteStatus can't remove one in between.
+func (s *Service) statusSet(ctx context.Context, r *repository.Repository, userID int) (statusSet, error) {
+	set := statusSet{}
+	for name := range transitions {
+		set[name] = name
+	}
+
+	custom, err := r.GetCardStatuses(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, cs := range custom {
+		set[cs.Name] = cs.Base
+	}
+	return set, nil
+}
+
+// transition checks that a card may move from status from to status to.
+// Statuses sharing a base that isn't final may move between each other.
+func (set statusSet) transition(from, to string) error {
+	toBase, ok := set[to]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownStatus, to)
+	}
+	if from == to {
+		return nil
+	}
+
+	// A status whose custom definition was removed behaves like todo.
+	fromBase, ok := set[from]
+	if !ok {
+		fromBase = StatusTodo
+	}
+
+	if fromBase == toBase && !isFinal(fromBase) || slices.Contains(transitions[fromBase], toBase) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+}
+
+func isFinal(base string) bool {
+	return len(transitions[base]) == 0
+}
+
+// setStatus moves c to status, stamping when it changed and marking the
+// card when the status is final.
+func (set statusSet) setStatus(c *repository.Card, status string, now time.Time) error {
+	if err := set.transition(cardStatus(c), status); err != nil {
+		return err
+	}
+	if status == cardStatus(c) && c.MarkedStatus != nil {
+		return nil
+	}
+
+	c.MarkedStatus = &status
+	c.StatusChangedAt = &now
+	c.Marked = nil
+	if isFinal(set[status]) {
+		c.Marked = &now
+	}
+	return nil
+}
+
+// cardStatus returns the status of c. Cards from before statuses were
+// enforced may have none, they count as todo.
+func cardStatus(c *repository.Card) string {
+	if c.MarkedStatus == nil || *c.MarkedStatus == "" {
+		return StatusTodo
+	}
+	return *c.MarkedStatus
+}
+
+// TransitionCard moves a card of the authenticated user to status. ifMatch
+// is optional here; when given it must name the current ETag.
+func (s *Service) TransitionCard(ctx context.Context, activitiesNo, status, ifMatch string) (Card, error) {
+	if ifMatch == "" {
+		ifMatch = "*"
+	}
+	return s.updateCard(ctx, activitiesNo, user.IDFromContext(ctx), ifMatch, func(r *repository.Repository, c *repository.Card) error {
+		set, err := s.statusSet(ctx, r, c.AuthorID)
+		if err != nil {
+			return err
+		}
+		return set.setStatus(c, status, time.Now())
+	})
+}
+
+// GetStatuses lists the built-in statuses followed by the custom statuses
+// of the authenticated user.
+func (s *Service) GetStatuses(ctx context.Context) ([]Status, error) {
+	res := make([]Status, 0, len(transitions))
+	for _, name := range []string{StatusTodo, StatusInProgress, StatusDone, StatusCancelled} {
+		res = append(res, Status{Name: name, Base: name, Final: isFinal(name)})
+	}
+
+	custom, err := repository.New(s.db).GetCardStatuses(ctx, user.IDFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, cs := range custom {
+		res = append(res, Status{Name: cs.Name, Base: cs.Base, Custom: true, Final: isFinal(cs.Base)})
+	}
+	return res, nil
+}
+
+// CreateStatus adds a custom status for the authenticated user, behaving
+// like the built-in status base.
+func (s *Service) CreateStatus(ctx context.Context, name, base string) (Status, error) {
+	if !statusNamePattern.MatchString(name) {
+		return Status{}, fmt.Errorf("%w: name must be lowercase letters, digits and underscores, up to 32 characters", ErrInvalidStatus)
+	}
+	if _, ok := transitions[name]; ok {
+		return Status{}, fmt.Errorf("%s %w", name, ErrStatusExists)
+	}
+	if _, ok := transitions[base]; !ok {
+		return Status{}, fmt.Errorf("%w: base must be a built-in status", ErrInvalidStatus)
+	}
+
+	userID := user.IDFromContext(ctx)
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		custom, err := r.GetCardStatuses(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if len(custom) >= maxCustomStatuses {
+			return fmt.Errorf("%w: at most %d custom statuses", ErrInvalidStatus, maxCustomStatuses)
+		}
+
+		err = r.CreateCardStatus(ctx, repository.CardStatus{UserID: userID, Name: name, Base: base})
+		if repository.IsDuplicate(err) {
+			return fmt.Errorf("%s %w", name, ErrStatusExists)
+		}
+		return err
+	})
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Name: name, Base: base, Custom: true, Final: isFinal(base)}, nil
+}
+
+// DeleteStatus removes a custom status of the authenticated user that no
+// card of the user is in. The status is locked before the cards are counted,
+// so a concurrent move into it either finishes first and is counted, or
+// waits and then finds the status gone.
+func (s *Service) DeleteStatus(ctx context.Context, name string) error {
+	userID := user.IDFromContext(ctx)
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		if r.CheckCardStatus(ctx, userID, name) == nil {
+			return fmt.Errorf("status %s %w", name, ErrNotFound)
+		}
+
+		n, err := r.CountCardsWithStatus(ctx, userID, name)
+		if err != nil {
+			return fmt.Errorf("error when checking status %s is unused: %w", name, err)
+		}
+		if n > 0 {
+			return fmt.Errorf("%s %w", name, ErrStatusInUse)
+		}
+
+		_, err = r.DeleteCardStatus(ctx, userID, name)
+		return err
+	})
+}
+
+func (s *Service) HandleTransitionCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Status string `json:"status"`
+		}
+
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, readErrorStatus(err), err)
+			return
+		}
+
+		c, err := s.TransitionCard(r.Context(), r.PathValue("id"), input.Status, r.Header.Get("If-Match"))
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		server.JSONResponse(w, http.StatusOK, c)
+	}
+}
+
+func (s *Service) HandleGetStatuses() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := s.GetStatuses(r.Context())
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, statuses)
+	}
+}
+
+func (s *Service) HandleCreateStatus() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Name string `json:"name"`
+			Base string `json:"base"`
+		}
+
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, readErrorStatus(err), err)
+			return
+		}
+
+		st, err := s.CreateStatus(r.Context(), input.Name, input.Base)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrStatusExists):
+				status = http.StatusConflict
+			case errors.Is(err, ErrInvalidStatus):
+				status = http.StatusUnprocessableEntity
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusCreated, st)
+	}
+}
+
+func (s *Service) HandleDeleteStatus() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.DeleteStatus(r.Context(), r.PathValue("name"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrStatusInUse):
+				status = http.StatusConflict
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,85 @@
+package card
+
+import (
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/user"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestHandleDeleteStatus(t *testing.T) {
+	lock := regexp.QuoteMeta("SELECT * FROM card_status WHERE user_id = ? AND name = ? LIMIT 1 FOR UPDATE")
+	count := regexp.QuoteMeta("SELECT COUNT(*) FROM card WHERE author_id = ? AND marked_status = ?")
+	remove := regexp.QuoteMeta("DELETE FROM card_status")
+	statusColumns := []string{"id", "user_id", "name", "base"}
+	locked := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(lock).WithArgs(5, "blocked").WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(1, 5, "blocked", StatusInProgress))
+	}
+
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "unused",
+			expect: func(mock sqlmock.Sqlmock) {
+				locked(mock)
+				mock.ExpectQuery(count).WithArgs(5, "blocked").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(remove).WithArgs(5, "blocked").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name: "in use",
+			expect: func(mock sqlmock.Sqlmock) {
+				locked(mock)
+				mock.ExpectQuery(count).WithArgs(5, "blocked").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				mock.ExpectRollback()
+			},
+			status: http.StatusConflict,
+		},
+		{
+			name: "in use check fails",
+			expect: func(mock sqlmock.Sqlmock) {
+				locked(mock)
+				mock.ExpectQuery(count).WithArgs(5, "blocked").WillReturnError(errors.New("connection lost"))
+				mock.ExpectRollback()
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "not found",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(lock).WithArgs(5, "blocked").WillReturnRows(sqlmock.NewRows(statusColumns))
+				mock.ExpectRollback()
+			},
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+			mock.ExpectBegin()
+			tt.expect(mock)
+
+			req := httptest.NewRequest(http.MethodDelete, "/statuses/blocked", nil)
+			req.SetPathValue("name", "blocked")
+			req = req.WithContext(user.NewContext(req.Context(), 5, ""))
+			rec := httptest.NewRecorder()
+			s.HandleDeleteStatus()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
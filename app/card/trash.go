@@ -0,0 +1,125 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/user"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var ErrNotInTrash = errors.New("card is not in the trash")
+
+// RestoreCard takes a deleted card of the authenticated user out of the
+// trash and returns it.
+func (s *Service) RestoreCard(ctx context.Context, activitiesNo string) (Card, error) {
+	authorID := user.IDFromContext(ctx)
+
+	var restored Card
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		c := r.CheckCard(ctx, activitiesNo, authorID)
+		if c == nil {
+			return fmt.Errorf("card %s from author id %v %w", activitiesNo, authorID, ErrNotFound)
+		}
+		if c.DeletedAt == nil {
+			return fmt.Errorf("card %s: %w", activitiesNo, ErrNotInTrash)
+		}
+
+		if err := r.RestoreCard(ctx, activitiesNo, authorID); err != nil {
+			return err
+		}
+
+		c = r.CheckCard(ctx, activitiesNo, authorID)
+		if c == nil {
+			return fmt.Errorf("card %s from author id %v %w", activitiesNo, authorID, ErrNotFound)
+		}
+		restored = mapCardRepoToService(*c)
+		return nil
+	})
+
+	return restored, err
+}
+
+// PurgeCard permanently removes a deleted card of the authenticated user.
+// Cards must be deleted before they can be purged.
+func (s *Service) PurgeCard(ctx context.Context, activitiesNo string) error {
+	authorID := user.IDFromContext(ctx)
+
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		c := r.CheckCard(ctx, activitiesNo, authorID)
+		if c == nil {
+			return fmt.Errorf("card %s from author id %v %w", activitiesNo, authorID, ErrNotFound)
+		}
+		if c.DeletedAt == nil {
+			return fmt.Errorf("card %s: %w", activitiesNo, ErrNotInTrash)
+		}
+
+		_, err := r.PurgeCard(ctx, activitiesNo, authorID)
+		return err
+	})
+}
+
+// PurgeTrash permanently removes cards deleted longer than retention ago,
+// every interval until ctx is done.
+func (s *Service) PurgeTrash(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := repository.New(s.db).PurgeDeletedCards(ctx, time.Now().Add(-retention))
+			if err != nil {
+				slog.Error("failed to purge trash", "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("purged deleted cards", "count", n)
+			}
+		}
+	}
+}
+
+func (s *Service) HandleRestoreCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := s.RestoreCard(r.Context(), r.PathValue("id"))
+		if err != nil {
+			trashErrorResponse(w, err)
+			return
+		}
+
+		server.SetValidators(w, c.ETag(), c.updatedAt)
+		server.JSONResponse(w, http.StatusOK, c)
+	}
+}
+
+func (s *Service) HandlePurgeCard() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.PurgeCard(r.Context(), r.PathValue("id"))
+		if err != nil {
+			trashErrorResponse(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func trashErrorResponse(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNotInTrash):
+		status = http.StatusConflict
+	}
+	server.ErrorResponse(w, status, err)
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Addr                string
+	DSN                 string
+	SessionStore        string
+	SessionAccessTTL    time.Duration
+	SessionAbsoluteTTL  time.Duration
+	SessionIdleTTL      time.Duration
+	SessionReapInterval time.Duration
+	// AuthMode is "session" for opaque access tokens looked up in the
+	// session store or "jwt" for signed tokens whose session is still
+	// checked against the store, so that revoking it ends the token.
+	AuthMode string
+	// JWTKeys lists kid:alg:base64-material entries, see jwt.ParseKeys.
+	JWTKeys       string
+	JWTSigningKey string
+	// BaseURL is the public address links in mail point to.
+	BaseURL string
+	// Mailer is "smtp", "log" (recipient and subject only), "file" (one
+	// file per message in MailDir, links included) or "memory".
+	Mailer       string
+	MailDir      string
+	MailFrom     string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	ResetTTL     time.Duration
+	// Secret signs links sent by mail, base64 encoded. When empty a random
+	// secret is generated, so links don't survive a restart.
+	Secret          string
+	VerifyTTL       time.Duration
+	RequireVerified bool
+	// Failed login throttling, see user.LockoutPolicy.
+	LoginMaxAccountAttempts int
+	LoginMaxIPAttempts      int
+	LoginBaseLockout        time.Duration
+	LoginMaxLockout         time.Duration
+	LoginWindow             time.Duration
+	AdminKey                string
+	// OIDCIssuer enables OpenID Connect login when set.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	// PasswordDenyList is a file of common passwords to refuse, one per
+	// line, replacing the list built into the binary.
+	PasswordDenyList   string
+	PasswordMinLength  int
+	PasswordMinClasses int
+	// PasswordCost is the bcrypt cost of new password hashes.
+	PasswordCost int
+	// Activity numbers, see card.Config.
+	CardNumberPrefix  string
+	CardNumberWidth   int
+	CardNumberPerUser bool
+	// CardTrashRetention is how long deleted cards are kept before they are
+	// purged for good. Zero keeps them forever.
+	CardTrashRetention time.Duration
+	CardPurgeInterval  time.Duration
+	// CardMarkedEditable lets marked cards be edited without reopening.
+	CardMarkedEditable bool
+}
+
+func Load() Config {
+	return Config{
+		Addr:                    getEnv("APP_ADDR", ":8080"),
+		DSN:                     getEnv("APP_DSN", "root:abc123@tcp(db:3306)/appdb?parseTime=true&loc=Asia%2FJakarta"),
+		SessionStore:            getEnv("SESSION_STORE", "mysql"),
+		SessionAccessTTL:        getDuration("SESSION_ACCESS_TTL", 15*time.Minute),
+		SessionAbsoluteTTL:      getDuration("SESSION_ABSOLUTE_TTL", 30*24*time.Hour),
+		SessionIdleTTL:          getDuration("SESSION_IDLE_TTL", 7*24*time.Hour),
+		SessionReapInterval:     getDuration("SESSION_REAP_INTERVAL", 10*time.Minute),
+		AuthMode:                getEnv("AUTH_MODE", "session"),
+		JWTKeys:                 getEnv("JWT_KEYS", ""),
+		JWTSigningKey:           getEnv("JWT_SIGNING_KEY", ""),
+		BaseURL:                 getEnv("APP_BASE_URL", "http://localhost:8080"),
+		Mailer:                  getEnv("MAILER", "log"),
+		MailDir:                 getEnv("MAIL_DIR", ".mail"),
+		MailFrom:                getEnv("MAIL_FROM", "no-reply@localhost"),
+		SMTPAddr:                getEnv("SMTP_ADDR", "localhost:25"),
+		SMTPUsername:            getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:            getEnv("SMTP_PASSWORD", ""),
+		ResetTTL:                getDuration("PASSWORD_RESET_TTL", time.Hour),
+		Secret:                  getEnv("APP_SECRET", ""),
+		VerifyTTL:               getDuration("EMAIL_VERIFY_TTL", 72*time.Hour),
+		RequireVerified:         getBool("REQUIRE_VERIFIED_EMAIL", false),
+		LoginMaxAccountAttempts: getInt("LOGIN_MAX_ACCOUNT_ATTEMPTS", 5),
+		LoginMaxIPAttempts:      getInt("LOGIN_MAX_IP_ATTEMPTS", 20),
+		LoginBaseLockout:        getDuration("LOGIN_BASE_LOCKOUT", time.Minute),
+		LoginMaxLockout:         getDuration("LOGIN_MAX_LOCKOUT", time.Hour),
+		LoginWindow:             getDuration("LOGIN_WINDOW", 15*time.Minute),
+		AdminKey:                getEnv("ADMIN_KEY", ""),
+		OIDCIssuer:              getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:            getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:        getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:         getEnv("OIDC_REDIRECT_URL", ""),
+		PasswordDenyList:        getEnv("PASSWORD_DENY_LIST", ""),
+		PasswordMinLength:       getInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMinClasses:      getInt("PASSWORD_MIN_CLASSES", 2),
+		PasswordCost:            getInt("PASSWORD_BCRYPT_COST", 10),
+		CardNumberPrefix:        getEnv("CARD_NUMBER_PREFIX", "AC-"),
+		CardNumberWidth:         getInt("CARD_NUMBER_WIDTH", 4),
+		CardNumberPerUser:       getBool("CARD_NUMBER_PER_USER", false),
+		CardTrashRetention:      getDuration("CARD_TRASH_RETENTION", 30*24*time.Hour),
+		CardPurgeInterval:       getDuration("CARD_PURGE_INTERVAL", time.Hour),
+		CardMarkedEditable:      getBool("CARD_MARKED_EDITABLE", false),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("invalid duration, using default", "key", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return d
+}
+
+func getBool(key string, fallback bool) bool {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("invalid bool, using default", "key", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+func getInt(key string, fallback int) int {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("invalid int, using default", "key", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return i
+}
@@ -2,11 +2,14 @@ module github.com/febriW/be-to-do
 
 go 1.23.1
 
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/georgysavva/scany/v2 v2.1.3
+	github.com/go-sql-driver/mysql v1.8.1
+	golang.org/x/crypto v0.28.0
+)
+
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/DATA-DOG/go-sqlmock v1.5.2 // indirect
-	github.com/georgysavva/scany/v2 v2.1.3 // indirect
-	github.com/go-sql-driver/mysql v1.8.1 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
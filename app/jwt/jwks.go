@@ -0,0 +1,50 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"github.com/febriW/be-to-do/server"
+	"net/http"
+)
+
+// JWK is the public part of an Ed25519 key as described in RFC 8037.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set. HS256 keys are shared secrets and
+// are never published.
+func (ks *KeySet) JWKS() JWKS {
+	res := JWKS{Keys: []JWK{}}
+	for _, id := range ks.order {
+		k := ks.keys[id]
+		if k.Alg != EdDSA {
+			continue
+		}
+		res.Keys = append(res.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k.public),
+			Kid: k.ID,
+			Alg: EdDSA,
+			Use: "sig",
+		})
+	}
+	return res
+}
+
+func (ks *KeySet) HandleJWKS() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		server.JSONResponse(w, http.StatusOK, ks.JWKS())
+	}
+}
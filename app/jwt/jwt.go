@@ -0,0 +1,242 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalid    = errors.New("invalid token")
+	ErrExpired    = errors.New("token expired")
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// minSecretLen is the shortest HS256 secret accepted (256 bits).
+const minSecretLen = 32
+
+type Claims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	ID        string `json:"jti"`
+	// SessionID ties the token to the session that minted it, so that the
+	// session endpoints keep working and revoking the session ends the token.
+	SessionID string `json:"sid,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Key is a signing key identified by the kid header of the tokens it signs.
+type Key struct {
+	ID      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func NewHS256Key(id string, secret []byte) (Key, error) {
+	if len(secret) < minSecretLen {
+		return Key{}, fmt.Errorf("key %s: HS256 secret must be at least %d bytes", id, minSecretLen)
+	}
+	return Key{ID: id, Alg: HS256, secret: secret}, nil
+}
+
+func NewEdDSAKey(id string, seed []byte) (Key, error) {
+	if len(seed) != ed25519.SeedSize {
+		return Key{}, fmt.Errorf("key %s: Ed25519 seed must be %d bytes", id, ed25519.SeedSize)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	return Key{ID: id, Alg: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+}
+
+// ParseKeys reads a comma separated list of kid:alg:base64-material entries,
+// where the material is the HS256 secret or the Ed25519 seed.
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("key entry %q: want kid:alg:material", entry)
+		}
+		material, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", parts[0], err)
+		}
+
+		var k Key
+		switch parts[1] {
+		case HS256:
+			k, err = NewHS256Key(parts[0], material)
+		case EdDSA:
+			k, err = NewEdDSAKey(parts[0], material)
+		default:
+			err = fmt.Errorf("key %s: unsupported alg %q", parts[0], parts[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// KeySet signs with one key and verifies with any of them, which allows
+// rotating keys: add the new key, make it the signing key, and drop the old
+// one once the tokens it signed have expired.
+type KeySet struct {
+	keys    map[string]Key
+	order   []string
+	signing string
+}
+
+func NewKeySet(signingID string, keys ...Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	ks := &KeySet{keys: make(map[string]Key, len(keys))}
+	for _, k := range keys {
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", k.ID)
+		}
+		ks.keys[k.ID] = k
+		ks.order = append(ks.order, k.ID)
+	}
+
+	if signingID == "" {
+		signingID = keys[0].ID
+	}
+	if _, ok := ks.keys[signingID]; !ok {
+		return nil, fmt.Errorf("signing key %s: %w", signingID, ErrUnknownKey)
+	}
+	ks.signing = signingID
+	return ks, nil
+}
+
+// Sign mints a token for c with the signing key. IssuedAt and ID are filled
+// in when empty.
+func (ks *KeySet) Sign(c Claims) (string, error) {
+	k := ks.keys[ks.signing]
+
+	if c.IssuedAt == 0 {
+		c.IssuedAt = time.Now().Unix()
+	}
+	if c.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return "", err
+		}
+		c.ID = id
+	}
+
+	h, err := json.Marshal(header{Alg: k.Alg, Typ: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(h) + "." + encode(p)
+	return signingInput + "." + encode(k.sign([]byte(signingInput))), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+func (ks *KeySet) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalid
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return Claims{}, ErrInvalid
+	}
+	k, ok := ks.keys[h.Kid]
+	if !ok {
+		return Claims{}, fmt.Errorf("kid %q: %w", h.Kid, ErrUnknownKey)
+	}
+	// The algorithm is bound to the key, never taken from the header alone.
+	if h.Alg != k.Alg {
+		return Claims{}, ErrInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !k.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return Claims{}, ErrInvalid
+	}
+
+	var c Claims
+	if err := decodeJSON(parts[1], &c); err != nil {
+		return Claims{}, ErrInvalid
+	}
+	if c.ExpiresAt == 0 || now.Unix() >= c.ExpiresAt {
+		return Claims{}, ErrExpired
+	}
+	return c, nil
+}
+
+func (k Key) sign(input []byte) []byte {
+	switch k.Alg {
+	case EdDSA:
+		return ed25519.Sign(k.private, input)
+	default:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func (k Key) verify(input, sig []byte) bool {
+	switch k.Alg {
+	case EdDSA:
+		return ed25519.Verify(k.public, input, sig)
+	default:
+		return hmac.Equal(k.sign(input), sig)
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate jti: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
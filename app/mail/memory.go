@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryMailer records messages instead of sending them. It is meant for
+// tests and local development.
+type MemoryMailer struct {
+	m    sync.Mutex
+	sent []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first.
+func (m *MemoryMailer) Sent() []Message {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return append([]Message(nil), m.sent...)
+}
+
+// LogMailer logs who a message was for and drops it. Bodies carry live
+// links and tokens, so they are never logged.
+type LogMailer struct{}
+
+func NewLogMailer() LogMailer {
+	return LogMailer{}
+}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.Info("mail not sent, no mailer configured", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// FileMailer writes each message to its own file in a directory, so that
+// mail sent by a local instance can be read without an SMTP server. The
+// files hold working reset and verification links; it is for development
+// only.
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create mail dir: %w", err)
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	f, err := os.CreateTemp(m.dir, time.Now().Format("20060102-150405")+"-*.txt")
+	if err != nil {
+		return fmt.Errorf("create mail file: %w", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	if err != nil {
+		return fmt.Errorf("write mail file: %w", err)
+	}
+	return nil
+}
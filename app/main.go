@@ -2,17 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"github.com/febriW/be-to-do/card"
+	"github.com/febriW/be-to-do/config"
+	"github.com/febriW/be-to-do/jwt"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/oidc"
+	"github.com/febriW/be-to-do/session"
 	"github.com/febriW/be-to-do/user"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	_ "embed"
 	_ "github.com/go-sql-driver/mysql"
+	_ "time/tzdata"
 )
 
 func NotImplemented(w http.ResponseWriter, r *http.Request) {
@@ -23,8 +35,9 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Allow all origins for development. Change "*" to your frontend URL in production.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Location")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		// Handle preflight OPTIONS request
@@ -38,25 +51,98 @@ func enableCORS(next http.Handler) http.Handler {
 }
 
 func main() {
-	db := initDB()
-	userService := user.NewService(db)
-	cardService := card.NewService(db)
+	cfg := config.Load()
+	db := initDB(cfg.DSN)
+	sessions := session.NewManager(newSessionStore(cfg, db), session.Config{
+		AccessTTL:   cfg.SessionAccessTTL,
+		AbsoluteTTL: cfg.SessionAbsoluteTTL,
+		IdleTTL:     cfg.SessionIdleTTL,
+	})
+	keys := newJWTKeySet(cfg)
+	userService := user.NewService(db, sessions, user.Config{
+		JWT:             keys,
+		Mailer:          newMailer(cfg),
+		BaseURL:         cfg.BaseURL,
+		ResetTTL:        cfg.ResetTTL,
+		Secret:          newSecret(cfg),
+		VerifyTTL:       cfg.VerifyTTL,
+		RequireVerified: cfg.RequireVerified,
+		Lockout: user.LockoutPolicy{
+			MaxAccountAttempts: cfg.LoginMaxAccountAttempts,
+			MaxIPAttempts:      cfg.LoginMaxIPAttempts,
+			BaseLockout:        cfg.LoginBaseLockout,
+			MaxLockout:         cfg.LoginMaxLockout,
+			Window:             cfg.LoginWindow,
+		},
+		AdminKey:       cfg.AdminKey,
+		OIDC:           newOIDCProvider(cfg),
+		PasswordPolicy: newPasswordPolicy(cfg),
+		PasswordCost:   newPasswordCost(cfg),
+	})
+	cardService := card.NewService(db, newCardConfig(cfg))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", NotImplemented)
+	if keys != nil {
+		mux.HandleFunc("GET /.well-known/jwks.json", keys.HandleJWKS())
+	}
 	mux.HandleFunc("POST /user/register", userService.HandleRegister())
+	mux.HandleFunc("GET /user/verify", userService.HandleVerifyEmail())
+	mux.HandleFunc("POST /user/verify/resend", userService.TokenMiddleware(user.RequireSession(userService.HandleResendVerification())))
 	mux.HandleFunc("POST /auth/login", userService.HandleLogin())
+	mux.HandleFunc("POST /auth/login/mfa", userService.HandleLoginMFA())
+	if cfg.OIDCIssuer != "" {
+		mux.HandleFunc("GET /auth/oidc/login", userService.HandleOIDCLogin())
+		mux.HandleFunc("GET /auth/oidc/callback", userService.HandleOIDCCallback())
+	}
+	mux.HandleFunc("POST /auth/refresh", userService.HandleRefresh())
+	mux.HandleFunc("POST /admin/users/unlock", userService.RequireAdminKey(userService.HandleUnlock()))
+	mux.HandleFunc("PUT /admin/users/{id}/role", userService.RequireAdminKey(userService.HandleSetRole()))
+	mux.HandleFunc("GET /admin/users", userService.TokenMiddleware(user.RequireSession(userService.RequireRole(user.RoleAdmin, userService.HandleGetUsers()))))
+	mux.HandleFunc("POST /admin/users/{id}/disable", userService.TokenMiddleware(user.RequireSession(userService.RequireRole(user.RoleAdmin, userService.HandleDisableUser()))))
+	mux.HandleFunc("POST /admin/users/{id}/enable", userService.TokenMiddleware(user.RequireSession(userService.RequireRole(user.RoleAdmin, userService.HandleEnableUser()))))
+	mux.HandleFunc("DELETE /admin/users/{id}/totp", userService.TokenMiddleware(user.RequireSession(userService.RequireRole(user.RoleAdmin, userService.HandleResetTOTP()))))
+	mux.HandleFunc("GET /admin/cards", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, userService.RequireRole(user.RoleAdmin, cardService.HandleGetAllCards()))))
+	mux.HandleFunc("GET /admin/cards/{id}", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, userService.RequireRole(user.RoleAdmin, cardService.HandleGetCard()))))
+	mux.HandleFunc("POST /auth/password/forgot", userService.HandleForgotPassword())
+	mux.HandleFunc("POST /auth/password/reset", userService.HandleResetPassword())
+	mux.HandleFunc("POST /auth/logout", userService.TokenMiddleware(user.RequireSession(userService.HandleLogout())))
+	mux.HandleFunc("POST /auth/logout-all", userService.TokenMiddleware(user.RequireSession(userService.HandleLogoutAll())))
+	mux.HandleFunc("GET /auth/sessions", userService.TokenMiddleware(user.RequireSession(userService.HandleGetSessions())))
+	mux.HandleFunc("DELETE /auth/sessions/{id}", userService.TokenMiddleware(user.RequireSession(userService.HandleDeleteSession())))
+	mux.HandleFunc("DELETE /auth/totp", userService.TokenMiddleware(user.RequireSession(userService.HandleDisableTOTP())))
+	mux.HandleFunc("GET /user/me", userService.TokenMiddleware(user.RequireSession(userService.HandleGetProfile())))
+	mux.HandleFunc("PATCH /user/me", userService.TokenMiddleware(user.RequireSession(userService.HandleUpdateProfile())))
+	mux.HandleFunc("DELETE /user/me", userService.TokenMiddleware(user.RequireSession(userService.HandleDeleteAccount())))
+	mux.HandleFunc("PUT /user/password", userService.TokenMiddleware(user.RequireSession(userService.HandleChangePassword())))
+	mux.HandleFunc("POST /user/2fa/enroll", userService.TokenMiddleware(user.RequireSession(userService.HandleEnrollTOTP())))
+	mux.HandleFunc("POST /user/2fa/confirm", userService.TokenMiddleware(user.RequireSession(userService.HandleConfirmTOTP())))
+	mux.HandleFunc("POST /user/tokens", userService.TokenMiddleware(user.RequireSession(userService.HandleCreateToken())))
+	mux.HandleFunc("GET /user/tokens", userService.TokenMiddleware(user.RequireSession(userService.HandleGetTokens())))
+	mux.HandleFunc("DELETE /user/tokens/{id}", userService.TokenMiddleware(user.RequireSession(userService.HandleDeleteToken())))
 
-	mux.HandleFunc("GET /card", user.TokenMiddleware(cardService.HandleGetAllCards()))
-	mux.HandleFunc("POST /card", user.TokenMiddleware(cardService.HandleCreateCard()))
-	mux.HandleFunc("PUT /card", user.TokenMiddleware(cardService.HandleUpdateCard()))
-	mux.HandleFunc("DELETE /card/{id}", user.TokenMiddleware(cardService.HandleDeleteCard()))
+	mux.HandleFunc("GET /card", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, cardService.HandleGetAllCards())))
+	mux.HandleFunc("GET /card/trash", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, cardService.HandleGetTrash())))
+	mux.HandleFunc("GET /card/{id}", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, cardService.HandleGetCard())))
+	mux.HandleFunc("POST /card", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, userService.RequireVerified(cardService.HandleCreateCard()))))
+	mux.HandleFunc("PUT /card", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleUpdateCard())))
+	mux.HandleFunc("PATCH /card/{id}", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandlePatchCard())))
+	mux.HandleFunc("DELETE /card/{id}", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleDeleteCard())))
+	mux.HandleFunc("POST /card/{id}/transition", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleTransitionCard())))
+	mux.HandleFunc("POST /card/{id}/reopen", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleReopenCard())))
+	mux.HandleFunc("GET /card/{id}/reopens", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, cardService.HandleGetReopens())))
+	mux.HandleFunc("POST /card/{id}/restore", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleRestoreCard())))
+	mux.HandleFunc("DELETE /card/{id}/purge", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandlePurgeCard())))
+
+	mux.HandleFunc("GET /statuses", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsRead, cardService.HandleGetStatuses())))
+	mux.HandleFunc("POST /statuses", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleCreateStatus())))
+	mux.HandleFunc("DELETE /statuses/{name}", userService.TokenMiddleware(user.RequireScope(user.ScopeCardsWrite, cardService.HandleDeleteStatus())))
 
 	handler := enableCORS(mux)
 
 	srv := &http.Server{
 		Handler:      handler,
-		Addr:         ":8080",
+		Addr:         cfg.Addr,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -64,8 +150,14 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	go sessions.Reap(ctx, newSessionReapInterval(cfg))
+	purgeInterval := newCardPurgeInterval(cfg)
+	if cfg.CardTrashRetention > 0 {
+		go cardService.PurgeTrash(ctx, purgeInterval, cfg.CardTrashRetention)
+	}
+
 	go func() {
-		fmt.Println("Server is running on http://localhost:8080")
+		fmt.Println("Server is running on http://localhost" + cfg.Addr)
 		if err := srv.ListenAndServe(); err != nil {
 			log.Fatalf("listen and serve returned err: %v", err)
 		}
@@ -80,8 +172,8 @@ func main() {
 
 }
 
-func initDB() *sql.DB {
-	db, err := sql.Open("mysql", "root:abc123@tcp(db:3306)/appdb?parseTime=true&loc=Asia%2FJakarta")
+func initDB(dsn string) *sql.DB {
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		panic(err)
 	}
@@ -93,3 +185,158 @@ func initDB() *sql.DB {
 
 	return db
 }
+
+func newSessionStore(cfg config.Config, db *sql.DB) session.Store {
+	switch cfg.SessionStore {
+	case "memory":
+		return session.NewMemoryStore()
+	case "mysql":
+		return session.NewMySQLStore(db)
+	default:
+		log.Fatalf("unknown session store %q", cfg.SessionStore)
+		return nil
+	}
+}
+
+func newSessionReapInterval(cfg config.Config) time.Duration {
+	if cfg.SessionReapInterval <= 0 {
+		log.Fatalf("SESSION_REAP_INTERVAL must be positive")
+	}
+	return cfg.SessionReapInterval
+}
+
+func newJWTKeySet(cfg config.Config) *jwt.KeySet {
+	switch cfg.AuthMode {
+	case "session":
+		return nil
+	case "jwt":
+		keys, err := jwt.ParseKeys(cfg.JWTKeys)
+		if err != nil {
+			log.Fatalf("invalid JWT_KEYS: %v", err)
+		}
+		ks, err := jwt.NewKeySet(cfg.JWTSigningKey, keys...)
+		if err != nil {
+			log.Fatalf("invalid JWT keys: %v", err)
+		}
+		return ks
+	default:
+		log.Fatalf("unknown auth mode %q", cfg.AuthMode)
+		return nil
+	}
+}
+
+func newMailer(cfg config.Config) mail.Mailer {
+	switch cfg.Mailer {
+	case "smtp":
+		return mail.NewSMTPMailer(mail.SMTPConfig{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		})
+	case "log":
+		return mail.NewLogMailer()
+	case "file":
+		m, err := mail.NewFileMailer(cfg.MailDir)
+		if err != nil {
+			log.Fatalf("file mailer: %v", err)
+		}
+		slog.Warn("MAILER=file stores working reset and verification links in plain text, use it for development only", "dir", cfg.MailDir)
+		return m
+	case "memory":
+		return mail.NewMemoryMailer()
+	default:
+		log.Fatalf("unknown mailer %q", cfg.Mailer)
+		return nil
+	}
+}
+
+func newSecret(cfg config.Config) []byte {
+	if cfg.Secret == "" {
+		slog.Warn("APP_SECRET not set, using a random secret; links sent by mail won't survive a restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("generate secret: %v", err)
+		}
+		return secret
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(cfg.Secret)
+	if err != nil || len(secret) < 32 {
+		log.Fatalf("APP_SECRET must be at least 32 base64 encoded bytes")
+	}
+	return secret
+}
+
+func newOIDCProvider(cfg config.Config) *oidc.Provider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+
+	redirectURL := cfg.OIDCRedirectURL
+	if redirectURL == "" {
+		redirectURL = cfg.BaseURL + "/auth/oidc/callback"
+	}
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// commonPasswords is the deny list used unless PASSWORD_DENY_LIST names
+// another file.
+//
+//go:embed common-passwords.txt
+var commonPasswords string
+
+func newPasswordPolicy(cfg config.Config) user.PasswordPolicy {
+	denied, err := user.ParseDenyList(strings.NewReader(commonPasswords))
+	if cfg.PasswordDenyList != "" {
+		denied, err = user.LoadDenyList(cfg.PasswordDenyList)
+	}
+	if err != nil {
+		log.Fatalf("password deny list: %v", err)
+	}
+
+	return user.PasswordPolicy{
+		MinLength:  cfg.PasswordMinLength,
+		MinClasses: cfg.PasswordMinClasses,
+		Denied:     denied,
+	}
+}
+
+func newPasswordCost(cfg config.Config) int {
+	if cfg.PasswordCost < bcrypt.MinCost || cfg.PasswordCost > bcrypt.MaxCost {
+		log.Fatalf("PASSWORD_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return cfg.PasswordCost
+}
+
+func newCardConfig(cfg config.Config) card.Config {
+	// Numbers must fit card.activities_no, VARCHAR(64), with room for a per
+	// user author id.
+	if len(cfg.CardNumberPrefix) > 20 {
+		log.Fatalf("CARD_NUMBER_PREFIX must be at most 20 characters")
+	}
+	if cfg.CardNumberWidth < 1 || cfg.CardNumberWidth > 20 {
+		log.Fatalf("CARD_NUMBER_WIDTH must be between 1 and 20")
+	}
+	return card.Config{
+		NumberPrefix:   cfg.CardNumberPrefix,
+		NumberWidth:    cfg.CardNumberWidth,
+		NumberPerUser:  cfg.CardNumberPerUser,
+		MarkedEditable: cfg.CardMarkedEditable,
+	}
+}
+
+func newCardPurgeInterval(cfg config.Config) time.Duration {
+	if cfg.CardTrashRetention < 0 {
+		log.Fatalf("CARD_TRASH_RETENTION must not be negative")
+	}
+	if cfg.CardTrashRetention > 0 && cfg.CardPurgeInterval <= 0 {
+		log.Fatalf("CARD_PURGE_INTERVAL must be positive")
+	}
+	return cfg.CardPurgeInterval
+}
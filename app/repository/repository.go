@@ -3,13 +3,18 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/georgysavva/scany/v2/dbscan"
+	"github.com/go-sql-driver/mysql"
 	"log/slog"
 	"strings"
 	"time"
 )
 
+// errDupEntry is MySQL's ER_DUP_ENTRY error number.
+const errDupEntry = 1062
+
 type DB interface {
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
@@ -21,12 +26,21 @@ type Repository struct {
 }
 
 type User struct {
-	ID           int    `db:"id"`
-	Name         string `db:"name"`
-	Email        string `db:"email"`
-	PasswordHash string `db:"password_hash"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID            int        `db:"id"`
+	Name          string     `db:"name"`
+	Email         string     `db:"email"`
+	PasswordHash  string     `db:"password_hash"`
+	VerifiedAt    *time.Time `db:"verified_at"`
+	TOTPSecret    *string    `db:"totp_secret"`
+	TOTPEnabledAt *time.Time `db:"totp_enabled_at"`
+	TOTPLastStep  *int64     `db:"totp_last_step"`
+	Timezone      *string    `db:"timezone"`
+	Locale        *string    `db:"locale"`
+	Role          string     `db:"role"`
+	DisabledAt    *time.Time `db:"disabled_at"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     *time.Time `db:"deleted_at"`
 }
 
 type Card struct {
@@ -36,13 +50,95 @@ type Card struct {
 	AuthorID     int        `json:"author_id"`
 	Marked       *time.Time `json:"marked"`
 	MarkedStatus *string    `json:"marked_status"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
-	DeletedAt    *time.Time `json:"deleted_at"`
+	// StatusChangedAt is stamped by the server on every status change.
+	StatusChangedAt *time.Time `json:"status_changed_at"`
+	Version         int        `json:"version"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	DeletedAt       *time.Time `json:"deleted_at"`
+}
+
+type Session struct {
+	ID              string    `db:"id"`
+	AccessHash      string    `db:"access_hash"`
+	RefreshHash     string    `db:"refresh_hash"`
+	UserID          int       `db:"user_id"`
+	CreatedAt       time.Time `db:"created_at"`
+	LastSeenAt      time.Time `db:"last_seen_at"`
+	AccessExpiresAt time.Time `db:"access_expires_at"`
+	ExpiresAt       time.Time `db:"expires_at"`
+	IP              string    `db:"ip"`
+	UserAgent       string    `db:"user_agent"`
+}
+
+type RotatedToken struct {
+	TokenHash string    `db:"token_hash"`
+	SessionID string    `db:"session_id"`
+	UserID    int       `db:"user_id"`
+	RotatedAt time.Time `db:"rotated_at"`
+}
+
+type AccessToken struct {
+	ID         int        `db:"id"`
+	UserID     int        `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	Scopes     string     `db:"scopes"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+type PasswordReset struct {
+	TokenHash string     `db:"token_hash"`
+	UserID    int        `db:"user_id"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+type LoginAttempt struct {
+	AttemptKey   string     `db:"attempt_key"`
+	Failures     int        `db:"failures"`
+	LastFailedAt time.Time  `db:"last_failed_at"`
+	LockedUntil  *time.Time `db:"locked_until"`
+}
+
+type UserIdentity struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Issuer    string    `db:"issuer"`
+	Subject   string    `db:"subject"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// CardStatus is a custom card status of one user, behaving like the built-in
+// status Base.
+type CardStatus struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Name      string    `db:"name"`
+	Base      string    `db:"base"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// CardReopen records who reopened a marked card and why.
+type CardReopen struct {
+	ID           int       `db:"id"`
+	ActivitiesNo string    `db:"activities_no"`
+	ReopenedBy   int       `db:"reopened_by"`
+	Reason       string    `db:"reason"`
+	FromStatus   string    `db:"from_status"`
+	ToStatus     string    `db:"to_status"`
+	CreatedAt    time.Time `db:"created_at"`
 }
 
 type CardsParam struct {
 	AuthorID int
+	// Deleted lists cards in the trash, most recently deleted first,
+	// instead of live ones.
+	Deleted bool
 	PaginationParams
 }
 
@@ -55,9 +151,28 @@ func New(db DB) *Repository {
 	return &Repository{db: db}
 }
 
+// ExecTx runs fn with a repository inside a transaction on db, committing
+// if fn returns nil and rolling back otherwise.
+func ExecTx(ctx context.Context, db *sql.DB, fn func(*Repository) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	repo := New(tx)
+	err = fn(repo)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("tx err: %w, rb err: %v", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // repository user
 func (r *Repository) CheckUser(ctx context.Context, email string) *User {
-	query := r.SelectQuery(`SELECT * FROM user WHERE email = ? LIMIT 1`)
+	query := r.SelectQuery(`SELECT * FROM user WHERE email = ? AND deleted_at IS NULL LIMIT 1`)
 	rows, err := r.db.QueryContext(ctx, query, email)
 
 	if err != nil {
@@ -75,16 +190,495 @@ func (r *Repository) CheckUser(ctx context.Context, email string) *User {
 	return &res
 }
 
-func (r *Repository) CreateUser(ctx context.Context, data User) error {
-	query := `INSERT INTO user (name, email, password_hash) VALUES (?, ?, ?)`
-	_, err := r.db.ExecContext(ctx, query, data.Name, data.Email, data.PasswordHash)
+func (r *Repository) CheckUserByID(ctx context.Context, id int) *User {
+	query := r.SelectQuery(`SELECT * FROM user WHERE id = ? AND deleted_at IS NULL LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, id)
+
 	if err != nil {
-		return err
+		slog.Error("failed to query user", "id", id, "err", err)
+		return nil
+	}
+
+	var res User
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		slog.Error("failed to scan user", "id", id, "err", err)
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) CreateUser(ctx context.Context, data User) (int, error) {
+	query := `INSERT INTO user (name, email, password_hash, verified_at) VALUES (?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, query, data.Name, data.Email, data.PasswordHash, data.VerifiedAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) UpdateUserPassword(ctx context.Context, id int, passwordHash string) error {
+	query := "UPDATE user SET password_hash = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, passwordHash, id)
+	return err
+}
+
+func (r *Repository) UpdateUserProfile(ctx context.Context, data User) error {
+	query := "UPDATE user SET name = ?, email = ?, verified_at = ?, timezone = ?, locale = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, data.Name, data.Email, data.VerifiedAt, data.Timezone, data.Locale, data.ID)
+	return err
+}
+
+// GetUsers lists users that aren't deleted, oldest first.
+func (r *Repository) GetUsers(ctx context.Context, param PaginationParams) ([]User, int, error) {
+	if param.Page <= 0 {
+		param.Page = 1
+	}
+
+	if param.Size <= 0 {
+		param.Size = 10
+	}
+
+	query := "SELECT * FROM user WHERE deleted_at IS NULL"
+	total := r.Count(ctx, query)
+	query = r.paginationQuery(query+" ORDER BY id", param)
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var res []User
+	if err := dbscan.ScanAll(&res, rows); err != nil {
+		return nil, 0, err
+	}
+	return res, total, nil
+}
+
+func (r *Repository) UpdateUserRole(ctx context.Context, id int, role string) error {
+	query := "UPDATE user SET role = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, role, id)
+	return err
+}
+
+// UpdateUserDisabled disables user id, or re-enables it for a nil
+// disabledAt.
+func (r *Repository) UpdateUserDisabled(ctx context.Context, id int, disabledAt *time.Time) error {
+	query := "UPDATE user SET disabled_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, disabledAt, id)
+	return err
+}
+
+// DeleteUser soft-deletes user id; CheckUser and CheckUserByID no longer
+// find it.
+func (r *Repository) DeleteUser(ctx context.Context, id int, deletedAt time.Time) error {
+	query := "UPDATE user SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, deletedAt, id)
+	return err
+}
+
+// VerifyUser marks user id verified if its email is still email, returning
+// the number of rows changed.
+func (r *Repository) VerifyUser(ctx context.Context, id int, email string, verifiedAt time.Time) (int, error) {
+	query := "UPDATE user SET verified_at = COALESCE(verified_at, ?) WHERE id = ? AND email = ?"
+	res, err := r.db.ExecContext(ctx, query, verifiedAt, id, email)
+	if err != nil {
+		return 0, err
 	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// UpdateUserTOTP stores a pending TOTP secret and disables two-factor
+// authentication until it is confirmed.
+func (r *Repository) UpdateUserTOTP(ctx context.Context, id int, secret *string) error {
+	query := "UPDATE user SET totp_secret = ?, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, secret, id)
+	return err
+}
+
+func (r *Repository) EnableUserTOTP(ctx context.Context, id int, enabledAt time.Time, step int64) error {
+	query := "UPDATE user SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, enabledAt, step, id)
+	return err
+}
+
+func (r *Repository) UpdateUserTOTPStep(ctx context.Context, id int, step int64) error {
+	query := "UPDATE user SET totp_last_step = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, step, id)
+	return err
+}
+
+// recovery code repository
+func (r *Repository) CreateRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	query := `INSERT INTO recovery_code (user_id, code_hash) VALUES (?, ?)`
+	_, err := r.db.ExecContext(ctx, query, userID, codeHash)
+	return err
+}
+
+// UseRecoveryCode spends an unused recovery code, returning the number of
+// codes spent.
+func (r *Repository) UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) (int, error) {
+	query := "UPDATE recovery_code SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL"
+	res, err := r.db.ExecContext(ctx, query, usedAt, userID, codeHash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *Repository) DeleteRecoveryCodes(ctx context.Context, userID int) error {
+	query := "DELETE FROM recovery_code WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// user identity repository
+func (r *Repository) CheckUserIdentity(ctx context.Context, issuer, subject string) *UserIdentity {
+	query := r.SelectQuery(`SELECT * FROM user_identity WHERE issuer = ? AND subject = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, issuer, subject)
+
+	if err != nil {
+		slog.Error("failed to query user identity", "issuer", issuer, "err", err)
+		return nil
+	}
+
+	var res UserIdentity
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan user identity", "issuer", issuer, "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) DeleteUserIdentities(ctx context.Context, userID int) error {
+	query := "DELETE FROM user_identity WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *Repository) CreateUserIdentity(ctx context.Context, data UserIdentity) error {
+	query := `INSERT INTO user_identity (user_id, issuer, subject, email) VALUES (?, ?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.UserID, data.Issuer, data.Subject, data.Email)
+	return err
+}
+
+// login attempt repository
+func (r *Repository) CheckLoginAttempt(ctx context.Context, key string) *LoginAttempt {
+	query := r.SelectQuery(`SELECT * FROM login_attempt WHERE attempt_key = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, key)
+
+	if err != nil {
+		slog.Error("failed to query login attempt", "key", key, "err", err)
+		return nil
+	}
+
+	var res LoginAttempt
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan login attempt", "key", key, "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) SaveLoginAttempt(ctx context.Context, data LoginAttempt) error {
+	query := `INSERT INTO login_attempt (attempt_key, failures, last_failed_at, locked_until) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE failures = VALUES(failures), last_failed_at = VALUES(last_failed_at), locked_until = VALUES(locked_until)`
+	_, err := r.db.ExecContext(ctx, query, data.AttemptKey, data.Failures, data.LastFailedAt, data.LockedUntil)
+	return err
+}
+
+func (r *Repository) DeleteLoginAttempt(ctx context.Context, key string) error {
+	query := "DELETE FROM login_attempt WHERE attempt_key = ?"
+	_, err := r.db.ExecContext(ctx, query, key)
+	return err
+}
+
+// password reset repository
+func (r *Repository) CheckPasswordReset(ctx context.Context, tokenHash string) *PasswordReset {
+	query := r.SelectQuery(`SELECT * FROM password_reset WHERE token_hash = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, tokenHash)
+
+	if err != nil {
+		slog.Error("failed to query password reset", "err", err)
+		return nil
+	}
+
+	var res PasswordReset
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan password reset", "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) CreatePasswordReset(ctx context.Context, data PasswordReset) error {
+	query := `INSERT INTO password_reset (token_hash, user_id, expires_at) VALUES (?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.TokenHash, data.UserID, data.ExpiresAt)
+	return err
+}
+
+// UsePasswordResets marks every unused reset token of a user as used.
+func (r *Repository) UsePasswordResets(ctx context.Context, userID int, usedAt time.Time) error {
+	query := "UPDATE password_reset SET used_at = ? WHERE user_id = ? AND used_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, usedAt, userID)
+	return err
+}
+
+// session repository
+func (r *Repository) CheckSession(ctx context.Context, accessHash string) *Session {
+	return r.checkSession(ctx, "access_hash", accessHash)
+}
+
+func (r *Repository) CheckSessionByRefresh(ctx context.Context, refreshHash string) *Session {
+	return r.checkSession(ctx, "refresh_hash", refreshHash)
+}
+
+func (r *Repository) CheckSessionByID(ctx context.Context, userID int, id string) *Session {
+	query := r.SelectQuery(`SELECT * FROM session WHERE user_id = ? AND id = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, userID, id)
+
+	if err != nil {
+		slog.Error("failed to query session", "err", err)
+		return nil
+	}
+
+	var res Session
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan session", "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) checkSession(ctx context.Context, column, hash string) *Session {
+	query := r.SelectQuery(`SELECT * FROM session WHERE ` + column + ` = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, hash)
+
+	if err != nil {
+		slog.Error("failed to query session", "err", err)
+		return nil
+	}
+
+	var res Session
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan session", "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) CreateSession(ctx context.Context, data Session) error {
+	query := `INSERT INTO session (id, access_hash, refresh_hash, user_id, created_at, last_seen_at, access_expires_at, expires_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.ID, data.AccessHash, data.RefreshHash, data.UserID, data.CreatedAt, data.LastSeenAt, data.AccessExpiresAt, data.ExpiresAt, data.IP, data.UserAgent)
+	return err
+}
+
+// RotateSession replaces the token hashes of session data.ID if its refresh
+// hash is still oldRefreshHash, returning the number of rows changed.
+func (r *Repository) RotateSession(ctx context.Context, oldRefreshHash string, data Session) (int, error) {
+	query := "UPDATE session SET access_hash = ?, refresh_hash = ?, access_expires_at = ?, last_seen_at = ? WHERE id = ? AND refresh_hash = ?"
+	res, err := r.db.ExecContext(ctx, query, data.AccessHash, data.RefreshHash, data.AccessExpiresAt, data.LastSeenAt, data.ID, oldRefreshHash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *Repository) CreateRotatedToken(ctx context.Context, data RotatedToken) error {
+	query := `INSERT INTO session_rotated_token (token_hash, session_id, user_id) VALUES (?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.TokenHash, data.SessionID, data.UserID)
+	return err
+}
+
+func (r *Repository) CheckRotatedToken(ctx context.Context, tokenHash string) *RotatedToken {
+	query := r.SelectQuery(`SELECT * FROM session_rotated_token WHERE token_hash = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, tokenHash)
+
+	if err != nil {
+		slog.Error("failed to query rotated token", "err", err)
+		return nil
+	}
+
+	var res RotatedToken
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan rotated token", "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) GetSessions(ctx context.Context, userID int) ([]Session, error) {
+	query := r.SelectQuery("SELECT * FROM session WHERE user_id = ? ORDER BY created_at")
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Session
+	err = dbscan.ScanAll(&res, rows)
+	return res, err
+}
+
+func (r *Repository) DeleteSession(ctx context.Context, userID int, id string) (int, error) {
+	query := "DELETE FROM session WHERE user_id = ? AND id = ?"
+	res, err := r.db.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *Repository) DeleteUserSessions(ctx context.Context, userID int) error {
+	query := "DELETE FROM session WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *Repository) TouchSession(ctx context.Context, id string, lastSeen time.Time) error {
+	query := "UPDATE session SET last_seen_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, lastSeen, id)
+	return err
+}
+
+func (r *Repository) DeleteExpiredSessions(ctx context.Context, now, idleSince time.Time) (int, error) {
+	query := "DELETE FROM session WHERE expires_at <= ? OR last_seen_at < ?"
+	res, err := r.db.ExecContext(ctx, query, now, idleSince)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// personal access token repository
+func (r *Repository) CheckAccessToken(ctx context.Context, tokenHash string) *AccessToken {
+	query := r.SelectQuery(`SELECT * FROM personal_access_token WHERE token_hash = ? LIMIT 1`)
+	return r.checkAccessToken(ctx, query, tokenHash)
+}
+
+func (r *Repository) CheckAccessTokenByID(ctx context.Context, userID, id int) *AccessToken {
+	query := r.SelectQuery(`SELECT * FROM personal_access_token WHERE user_id = ? AND id = ? LIMIT 1`)
+	return r.checkAccessToken(ctx, query, userID, id)
+}
+
+func (r *Repository) checkAccessToken(ctx context.Context, query string, args ...any) *AccessToken {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		slog.Error("failed to query access token", "err", err)
+		return nil
+	}
+
+	var res AccessToken
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan access token", "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) CreateAccessToken(ctx context.Context, data AccessToken) (int, error) {
+	query := `INSERT INTO personal_access_token (user_id, name, token_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, query, data.UserID, data.Name, data.TokenHash, data.Scopes, data.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) GetAccessTokens(ctx context.Context, userID int) ([]AccessToken, error) {
+	query := r.SelectQuery("SELECT * FROM personal_access_token WHERE user_id = ? ORDER BY created_at")
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []AccessToken
+	err = dbscan.ScanAll(&res, rows)
+	return res, err
+}
+
+func (r *Repository) TouchAccessToken(ctx context.Context, id int, lastUsed time.Time) error {
+	query := "UPDATE personal_access_token SET last_used_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, lastUsed, id)
+	return err
+}
+
+func (r *Repository) DeleteAccessToken(ctx context.Context, userID, id int) (int, error) {
+	query := "DELETE FROM personal_access_token WHERE user_id = ? AND id = ?"
+	res, err := r.db.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *Repository) DeleteUserAccessTokens(ctx context.Context, userID int) error {
+	query := "DELETE FROM personal_access_token WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, query, userID)
 	return err
 }
 
 // card repository
+// CheckCardByNo finds a card of any author.
+func (r *Repository) CheckCardByNo(ctx context.Context, activitiesNo string) *Card {
+	query := r.SelectQuery(`SELECT * FROM card WHERE activities_no = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, activitiesNo)
+
+	if err != nil {
+		slog.Error("failed to query card", "activities_no", activitiesNo, "err", err)
+		return nil
+	}
+
+	var res Card
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan card", "activities_no", activitiesNo, "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
 func (r *Repository) CheckCard(ctx context.Context, activitiesNo string, authorID int) *Card {
 	query := r.SelectQuery(`SELECT * FROM card WHERE activities_no = ? AND author_id = ? LIMIT 1`)
 	rows, err := r.db.QueryContext(ctx, query, activitiesNo, authorID)
@@ -105,35 +699,215 @@ func (r *Repository) CheckCard(ctx context.Context, activitiesNo string, authorI
 }
 
 func (r *Repository) DeleteCard(ctx context.Context, ActivitiesNo string, AuthorID int) error {
-	query := "UPDATE card SET deleted_at = ? WHERE activities_no = ? AND author_id = ?"
+	query := "UPDATE card SET deleted_at = ?, version = version + 1 WHERE activities_no = ? AND author_id = ?"
 	_, err := r.db.ExecContext(ctx, query, time.Now(), ActivitiesNo, AuthorID)
 	return err
 }
 
-func (r *Repository) UpdateCard(ctx context.Context, data Card) error {
-	fmt.Printf("data on update card repo: %s", data)
-	query := "UPDATE card SET title = ?, content = ?, marked = ?, marked_status = ? WHERE activities_no = ? AND author_id = ?"
-	_, err := r.db.ExecContext(ctx, query, data.Title, data.Content, data.Marked, data.MarkedStatus, data.ActivitiesNo, data.AuthorID)
+// RestoreCard takes a card of the author out of the trash.
+func (r *Repository) RestoreCard(ctx context.Context, activitiesNo string, authorID int) error {
+	query := "UPDATE card SET deleted_at = NULL, version = version + 1 WHERE activities_no = ? AND author_id = ?"
+	_, err := r.db.ExecContext(ctx, query, activitiesNo, authorID)
 	return err
 }
 
-func (r *Repository) CreateCard(ctx context.Context, data Card) error {
-	selectQuery := r.SelectQuery("SELECT * FROM card")
-	latestActivities := r.Count(ctx, selectQuery)
-	if latestActivities == 0 {
-		latestActivities = 1
-	} else {
-		latestActivities += 1
+// PurgeCard permanently removes a card of the author that is in the trash,
+// returning the number of cards removed.
+func (r *Repository) PurgeCard(ctx context.Context, activitiesNo string, authorID int) (int, error) {
+	query := "DELETE FROM card WHERE activities_no = ? AND author_id = ? AND deleted_at IS NOT NULL"
+	res, err := r.db.ExecContext(ctx, query, activitiesNo, authorID)
+	if err != nil {
+		return 0, err
 	}
-	activitiesNo := fmt.Sprintf("AC-%04d", latestActivities)
-	query := `INSERT INTO card (activities_no, author_id, title, content, marked) VALUES (?,?,?,?,?)`
-	_, err := r.db.ExecContext(ctx, query, activitiesNo, data.AuthorID, data.Title, data.Content, data.Marked)
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// PurgeDeletedCards permanently removes cards deleted before the given time,
+// returning the number of cards removed.
+func (r *Repository) PurgeDeletedCards(ctx context.Context, before time.Time) (int, error) {
+	query := "DELETE FROM card WHERE deleted_at < ?"
+	res, err := r.db.ExecContext(ctx, query, before)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// DeleteUserCards soft-deletes every card of the author that isn't deleted
+// yet.
+func (r *Repository) DeleteUserCards(ctx context.Context, authorID int, deletedAt time.Time) error {
+	query := "UPDATE card SET deleted_at = ?, version = version + 1 WHERE author_id = ? AND deleted_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, deletedAt, authorID)
 	return err
 }
 
+// UpdateCard saves data over the card if it is still at data.Version and
+// bumps the version, returning the number of rows changed.
+func (r *Repository) UpdateCard(ctx context.Context, data Card) (int, error) {
+	query := `UPDATE card SET title = ?, content = ?, marked = ?, marked_status = ?, status_changed_at = ?, version = version + 1
+		WHERE activities_no = ? AND author_id = ? AND version = ?`
+	res, err := r.db.ExecContext(ctx, query, data.Title, data.Content, data.Marked, data.MarkedStatus, data.StatusChangedAt,
+		data.ActivitiesNo, data.AuthorID, data.Version)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CreateCard inserts data and returns the card as stored, with the
+// defaults filled in by the database.
+func (r *Repository) CreateCard(ctx context.Context, data Card) (Card, error) {
+	query := `INSERT INTO card (activities_no, author_id, title, content, marked, marked_status, status_changed_at) VALUES (?,?,?,?,?,?,?)`
+	_, err := r.db.ExecContext(ctx, query, data.ActivitiesNo, data.AuthorID, data.Title, data.Content, data.Marked,
+		data.MarkedStatus, data.StatusChangedAt)
+	if err != nil {
+		return Card{}, err
+	}
+
+	c := r.CheckCard(ctx, data.ActivitiesNo, data.AuthorID)
+	if c == nil {
+		return Card{}, fmt.Errorf("card %s not found after insert", data.ActivitiesNo)
+	}
+	return *c, nil
+}
+
+// card status repository
+func (r *Repository) GetCardStatuses(ctx context.Context, userID int) ([]CardStatus, error) {
+	query := r.SelectQuery("SELECT * FROM card_status WHERE user_id = ? ORDER BY id")
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []CardStatus
+	if err := dbscan.ScanAll(&res, rows); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *Repository) CheckCardStatus(ctx context.Context, userID int, name string) *CardStatus {
+	query := r.SelectQuery(`SELECT * FROM card_status WHERE user_id = ? AND name = ? LIMIT 1`)
+	rows, err := r.db.QueryContext(ctx, query, userID, name)
+
+	if err != nil {
+		slog.Error("failed to query card status", "user_id", userID, "name", name, "err", err)
+		return nil
+	}
+
+	var res CardStatus
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		if !dbscan.NotFound(err) {
+			slog.Error("failed to scan card status", "user_id", userID, "name", name, "err", err)
+		}
+		return nil
+	}
+
+	return &res
+}
+
+func (r *Repository) CreateCardStatus(ctx context.Context, data CardStatus) error {
+	query := `INSERT INTO card_status (user_id, name, base) VALUES (?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.UserID, data.Name, data.Base)
+	return err
+}
+
+func (r *Repository) DeleteCardStatus(ctx context.Context, userID int, name string) (int, error) {
+	query := "DELETE FROM card_status WHERE user_id = ? AND name = ?"
+	res, err := r.db.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CountCardsWithStatus counts the cards of the author in status, including
+// the trash.
+func (r *Repository) CountCardsWithStatus(ctx context.Context, authorID int, status string) (int, error) {
+	query := "SELECT COUNT(*) FROM card WHERE author_id = ? AND marked_status = ?"
+	rows, err := r.db.QueryContext(ctx, query, authorID, status)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	if err := dbscan.ScanOne(&n, rows); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// card reopen repository
+func (r *Repository) CreateCardReopen(ctx context.Context, data CardReopen) error {
+	query := `INSERT INTO card_reopen (activities_no, reopened_by, reason, from_status, to_status) VALUES (?, ?, ?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, query, data.ActivitiesNo, data.ReopenedBy, data.Reason, data.FromStatus, data.ToStatus)
+	return err
+}
+
+func (r *Repository) GetCardReopens(ctx context.Context, activitiesNo string) ([]CardReopen, error) {
+	query := "SELECT * FROM card_reopen WHERE activities_no = ? ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, activitiesNo)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []CardReopen
+	if err := dbscan.ScanAll(&res, rows); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// NextSequence increments the named counter and returns its new value. A
+// counter is created on first use and continues after the highest number
+// already stored under prefix, so that cards numbered before the counter
+// existed keep their numbers to themselves. Inside a transaction the
+// counter row stays locked until commit, and a rollback gives the value
+// back.
+func (r *Repository) NextSequence(ctx context.Context, scope, prefix string) (int64, error) {
+	// LAST_INSERT_ID(expr) hands the new value back through the result
+	// without a second query.
+	query := `INSERT INTO card_sequence (scope, last_value) VALUES (?, 0)
+		ON DUPLICATE KEY UPDATE last_value = LAST_INSERT_ID(last_value + 1)`
+	res, err := r.db.ExecContext(ctx, query, scope)
+	if err != nil {
+		return 0, err
+	}
+	// MySQL reports an upsert that updated as two affected rows.
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return res.LastInsertId()
+	}
+
+	// The counter is new. Concurrent callers wait on its row while it is
+	// seeded.
+	query = `SELECT COALESCE(MAX(CAST(SUBSTRING(activities_no, CHAR_LENGTH(?) + 1) AS UNSIGNED)), 0) FROM card
+		WHERE LEFT(activities_no, CHAR_LENGTH(?)) = ? AND SUBSTRING(activities_no, CHAR_LENGTH(?) + 1) REGEXP '^[0-9]+$'`
+	rows, err := r.db.QueryContext(ctx, query, prefix, prefix, prefix, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	if err := dbscan.ScanOne(&last, rows); err != nil {
+		return 0, err
+	}
+
+	last++
+	query = `UPDATE card_sequence SET last_value = ? WHERE scope = ?`
+	if _, err := r.db.ExecContext(ctx, query, last, scope); err != nil {
+		return 0, err
+	}
+	return last, nil
+}
+
 func (r *Repository) GetCards(ctx context.Context, param CardsParam) ([]Card, int) {
 	if param.Page <= 0 {
 		param.Page = 1
@@ -143,15 +917,22 @@ func (r *Repository) GetCards(ctx context.Context, param CardsParam) ([]Card, in
 		param.Size = 10
 	}
 
-	query := r.SelectQuery("SELECT * FROM card")
+	// A zero AuthorID lists every author; callers decide who may do that.
+	query := r.SelectQuery("SELECT * FROM card WHERE deleted_at IS NULL")
+	if param.Deleted {
+		query = r.SelectQuery("SELECT * FROM card WHERE deleted_at IS NOT NULL")
+	}
 	var args []any
 
 	if param.AuthorID > 0 {
-		query += " WHERE author_id = ? AND deleted_at IS NULL"
+		query += " AND author_id = ?"
 		args = append(args, param.AuthorID)
 	}
 
 	total := r.Count(ctx, query, args...)
+	if param.Deleted {
+		query += " ORDER BY deleted_at DESC"
+	}
 	query = r.paginationQuery(query, param.PaginationParams)
 	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -203,3 +984,9 @@ func (r *Repository) Count(ctx context.Context, query string, args ...any) int {
 	dbscan.ScanOne(&total, rows)
 	return total
 }
+
+// IsDuplicate reports whether err is a unique key violation.
+func IsDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errDupEntry
+}
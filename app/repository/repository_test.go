@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"regexp"
+	"testing"
+)
+
+func TestNextSequence(t *testing.T) {
+	upsert := regexp.QuoteMeta("INSERT INTO card_sequence (scope, last_value) VALUES (?, 0)")
+	highest := regexp.QuoteMeta("SELECT COALESCE(MAX(CAST(SUBSTRING(activities_no, CHAR_LENGTH(?) + 1) AS UNSIGNED)), 0) FROM card")
+	seed := regexp.QuoteMeta("UPDATE card_sequence SET last_value = ? WHERE scope = ?")
+
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		want   int64
+	}{
+		{
+			name: "new counter after existing cards",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(upsert).WithArgs("card").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(highest).WithArgs("C-", "C-", "C-", "C-").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(41))
+				mock.ExpectExec(seed).WithArgs(int64(42), "card").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: 42,
+		},
+		{
+			name: "new counter without cards",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(upsert).WithArgs("card").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(highest).WithArgs("C-", "C-", "C-", "C-").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(0))
+				mock.ExpectExec(seed).WithArgs(int64(1), "card").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: 1,
+		},
+		{
+			name: "existing counter",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(upsert).WithArgs("card").WillReturnResult(sqlmock.NewResult(43, 2))
+			},
+			want: 43,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			tt.expect(mock)
+
+			got, err := New(db).NextSequence(context.Background(), "card", "C-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("NextSequence = %d, want %d", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
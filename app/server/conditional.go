@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetValidators sets the ETag and Last-Modified headers of a response.
+// A zero modified time leaves Last-Modified out.
+func SetValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// NotModified reports whether a GET for a resource with etag and modified
+// can be answered with 304 Not Modified. If-None-Match takes precedence over
+// If-Modified-Since, as RFC 9110 requires.
+func NotModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return ETagListMatch(inm, etag, false)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(t)
+}
+
+// ETagListMatch reports whether the If-Match or If-None-Match header value
+// list names etag. "*" matches any etag. Strong comparison, used for
+// If-Match, never matches weak tags.
+func ETagListMatch(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if strong {
+			if tag == etag && !strings.HasPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
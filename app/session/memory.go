@@ -0,0 +1,197 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in process memory. Sessions are lost on restart
+// and are not shared between instances.
+type MemoryStore struct {
+	m        sync.Mutex
+	sessions map[string]Session
+	// byAccess, byRefresh and rotated map token hashes to session IDs.
+	byAccess  map[string]string
+	byRefresh map[string]string
+	rotated   map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:  make(map[string]Session),
+		byAccess:  make(map[string]string),
+		byRefresh: make(map[string]string),
+		rotated:   make(map[string]string),
+	}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, sess Session) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.sessions[sess.ID]; ok {
+		return ErrDuplicate
+	}
+	if s.taken(sess.AccessHash, sess.RefreshHash) {
+		return ErrDuplicate
+	}
+	s.put(sess)
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, accessHash string) (Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[s.byAccess[accessHash]]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *MemoryStore) GetByRefresh(ctx context.Context, refreshHash string) (Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[s.byRefresh[refreshHash]]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *MemoryStore) GetByID(ctx context.Context, userID int, id string) (Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[id]
+	if !ok || v.UserID != userID {
+		return Session{}, ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *MemoryStore) Rotate(ctx context.Context, oldRefreshHash string, next Session) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[next.ID]
+	if !ok || v.RefreshHash != oldRefreshHash {
+		return ErrNotFound
+	}
+	if s.taken(next.AccessHash, next.RefreshHash) {
+		return ErrDuplicate
+	}
+
+	delete(s.byAccess, v.AccessHash)
+	delete(s.byRefresh, v.RefreshHash)
+	s.put(next)
+	s.rotated[oldRefreshHash] = next.ID
+	return nil
+}
+
+func (s *MemoryStore) Rotated(ctx context.Context, refreshHash string) (int, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[s.rotated[refreshHash]]
+	if !ok {
+		return 0, "", ErrNotFound
+	}
+	return v.UserID, v.ID, nil
+}
+
+func (s *MemoryStore) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	v.LastSeenAt = lastSeen
+	s.sessions[id] = v
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpired(ctx context.Context, now, idleSince time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n := 0
+	for _, v := range s.sessions {
+		if !now.Before(v.ExpiresAt) || v.LastSeenAt.Before(idleSince) {
+			s.remove(v)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, userID int) ([]Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var res []Session
+	for _, v := range s.sessions {
+		if v.UserID == userID {
+			res = append(res, v)
+		}
+	}
+	slices.SortFunc(res, func(a, b Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return res, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, userID int, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	v, ok := s.sessions[id]
+	if !ok || v.UserID != userID {
+		return ErrNotFound
+	}
+	s.remove(v)
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, userID int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, v := range s.sessions {
+		if v.UserID == userID {
+			s.remove(v)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) taken(accessHash, refreshHash string) bool {
+	_, access := s.byAccess[accessHash]
+	_, refresh := s.byRefresh[refreshHash]
+	_, rotated := s.rotated[refreshHash]
+	return access || refresh || rotated
+}
+
+func (s *MemoryStore) put(sess Session) {
+	s.sessions[sess.ID] = sess
+	s.byAccess[sess.AccessHash] = sess.ID
+	s.byRefresh[sess.RefreshHash] = sess.ID
+}
+
+// remove deletes sess and every index entry pointing at it.
+func (s *MemoryStore) remove(sess Session) {
+	delete(s.sessions, sess.ID)
+	delete(s.byAccess, sess.AccessHash)
+	delete(s.byRefresh, sess.RefreshHash)
+	for hash, id := range s.rotated {
+		if id == sess.ID {
+			delete(s.rotated, hash)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"github.com/febriW/be-to-do/repository"
+	"time"
+)
+
+// MySQLStore keeps sessions in the session table so they survive restarts
+// and can be shared by every instance pointing at the same database.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) Save(ctx context.Context, sess Session) error {
+	err := repository.New(s.db).CreateSession(ctx, mapSessionToRepo(sess))
+	if repository.IsDuplicate(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *MySQLStore) Get(ctx context.Context, accessHash string) (Session, error) {
+	sess := repository.New(s.db).CheckSession(ctx, accessHash)
+	if sess == nil {
+		return Session{}, ErrNotFound
+	}
+	return mapSessionRepoToSession(*sess), nil
+}
+
+func (s *MySQLStore) GetByRefresh(ctx context.Context, refreshHash string) (Session, error) {
+	sess := repository.New(s.db).CheckSessionByRefresh(ctx, refreshHash)
+	if sess == nil {
+		return Session{}, ErrNotFound
+	}
+	return mapSessionRepoToSession(*sess), nil
+}
+
+func (s *MySQLStore) GetByID(ctx context.Context, userID int, id string) (Session, error) {
+	sess := repository.New(s.db).CheckSessionByID(ctx, userID, id)
+	if sess == nil {
+		return Session{}, ErrNotFound
+	}
+	return mapSessionRepoToSession(*sess), nil
+}
+
+func (s *MySQLStore) Rotate(ctx context.Context, oldRefreshHash string, next Session) error {
+	err := repository.ExecTx(ctx, s.db, func(r *repository.Repository) error {
+		n, err := r.RotateSession(ctx, oldRefreshHash, mapSessionToRepo(next))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		return r.CreateRotatedToken(ctx, repository.RotatedToken{
+			TokenHash: oldRefreshHash,
+			SessionID: next.ID,
+			UserID:    next.UserID,
+		})
+	})
+	if repository.IsDuplicate(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *MySQLStore) Rotated(ctx context.Context, refreshHash string) (int, string, error) {
+	t := repository.New(s.db).CheckRotatedToken(ctx, refreshHash)
+	if t == nil {
+		return 0, "", ErrNotFound
+	}
+	return t.UserID, t.SessionID, nil
+}
+
+func (s *MySQLStore) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	return repository.New(s.db).TouchSession(ctx, id, lastSeen)
+}
+
+func (s *MySQLStore) DeleteExpired(ctx context.Context, now, idleSince time.Time) (int, error) {
+	return repository.New(s.db).DeleteExpiredSessions(ctx, now, idleSince)
+}
+
+func (s *MySQLStore) List(ctx context.Context, userID int) ([]Session, error) {
+	ss, err := repository.New(s.db).GetSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Session, 0, len(ss))
+	for _, sess := range ss {
+		res = append(res, mapSessionRepoToSession(sess))
+	}
+	return res, nil
+}
+
+func (s *MySQLStore) Delete(ctx context.Context, userID int, id string) error {
+	n, err := repository.New(s.db).DeleteSession(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MySQLStore) DeleteUser(ctx context.Context, userID int) error {
+	return repository.New(s.db).DeleteUserSessions(ctx, userID)
+}
+
+func mapSessionToRepo(data Session) repository.Session {
+	return repository.Session{
+		ID:              data.ID,
+		AccessHash:      data.AccessHash,
+		RefreshHash:     data.RefreshHash,
+		UserID:          data.UserID,
+		CreatedAt:       data.CreatedAt,
+		LastSeenAt:      data.LastSeenAt,
+		AccessExpiresAt: data.AccessExpiresAt,
+		ExpiresAt:       data.ExpiresAt,
+		IP:              data.IP,
+		UserAgent:       data.UserAgent,
+	}
+}
+
+func mapSessionRepoToSession(data repository.Session) Session {
+	return Session{
+		ID:              data.ID,
+		AccessHash:      data.AccessHash,
+		RefreshHash:     data.RefreshHash,
+		UserID:          data.UserID,
+		CreatedAt:       data.CreatedAt,
+		LastSeenAt:      data.LastSeenAt,
+		AccessExpiresAt: data.AccessExpiresAt,
+		ExpiresAt:       data.ExpiresAt,
+		IP:              data.IP,
+		UserAgent:       data.UserAgent,
+	}
+}
@@ -1,43 +1,361 @@
 package session
 
 import (
-	"math/rand/v2"
-	"strings"
-	"sync"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
 )
 
 var (
-	m            sync.Mutex
-	sessionStore = make(map[string]int)
+	ErrNotFound        = errors.New("unknown session token")
+	ErrExpired         = errors.New("session expired")
+	ErrDuplicate       = errors.New("session already exists")
+	ErrNotAccessToken  = errors.New("refresh token can't be used as access token")
+	ErrRefreshReused   = errors.New("refresh token reused, session revoked")
+	ErrNotRefreshToken = errors.New("not a refresh token")
 )
 
-func Create(id int) string {
-	m.Lock()
-	defer m.Unlock()
+// saveAttempts bounds how many fresh tokens Create tries when the store
+// reports a collision.
+const saveAttempts = 3
 
-	key := generate(8)
-	if _, ok := sessionStore[key]; !ok {
-		sessionStore[key] = id
+// touchInterval limits how often a session's last-seen time is written back
+// to the store, so that busy clients don't turn every request into a write.
+const touchInterval = time.Minute
+
+// Session is one login of a user. It owns a short-lived access token and a
+// long-lived refresh token; refreshing rotates both but keeps the session, so
+// a session is also the family that refresh tokens belong to.
+type Session struct {
+	// ID identifies the session to its owner without revealing the tokens.
+	ID string
+	// AccessHash and RefreshHash are SHA-256 hashes of the bearer tokens;
+	// the tokens themselves are never stored.
+	AccessHash      string
+	RefreshHash     string
+	UserID          int
+	CreatedAt       time.Time
+	LastSeenAt      time.Time
+	AccessExpiresAt time.Time
+	// ExpiresAt ends the session, and with it the refresh token.
+	ExpiresAt time.Time
+	IP        string
+	UserAgent string
+}
+
+// Meta describes the client a session is created for.
+type Meta struct {
+	IP        string
+	UserAgent string
+}
+
+// Tokens are handed to the client when a session is created or refreshed.
+type Tokens struct {
+	UserID           int
+	SessionID        string
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// Store persists sessions keyed by token hash. It holds no policy: expiry is
+// decided by Manager.
+type Store interface {
+	// Save inserts a new session, returning ErrDuplicate if its ID or one of
+	// its token hashes is already taken.
+	Save(ctx context.Context, s Session) error
+	Get(ctx context.Context, accessHash string) (Session, error)
+	GetByRefresh(ctx context.Context, refreshHash string) (Session, error)
+	// GetByID returns session id, or ErrNotFound if it doesn't belong to
+	// userID.
+	GetByID(ctx context.Context, userID int, id string) (Session, error)
+	// Rotate swaps the tokens of session next.ID for those in next, provided
+	// its refresh hash is still oldRefreshHash, and remembers oldRefreshHash
+	// as rotated. It returns ErrNotFound if the refresh hash has moved on and
+	// ErrDuplicate if one of the new hashes is taken.
+	Rotate(ctx context.Context, oldRefreshHash string, next Session) error
+	// Rotated returns the owner and ID of the session that rotated away
+	// refreshHash, or ErrNotFound.
+	Rotated(ctx context.Context, refreshHash string) (int, string, error)
+	Touch(ctx context.Context, id string, lastSeen time.Time) error
+	List(ctx context.Context, userID int) ([]Session, error)
+	Delete(ctx context.Context, userID int, id string) error
+	DeleteUser(ctx context.Context, userID int) error
+	// DeleteExpired removes sessions past their absolute expiry or not seen
+	// since idleSince, returning how many were removed.
+	DeleteExpired(ctx context.Context, now, idleSince time.Time) (int, error)
+}
+
+type Config struct {
+	// AccessTTL is the lifetime of an access token. Clients get a new one
+	// from the refresh token.
+	AccessTTL time.Duration
+	// AbsoluteTTL caps the lifetime of a session, and so of its refresh
+	// tokens, regardless of activity.
+	AbsoluteTTL time.Duration
+	// IdleTTL ends a session that has not been used for this long. Each
+	// authenticated request slides the window forward. Zero disables it.
+	IdleTTL time.Duration
+}
+
+type Manager struct {
+	store Store
+	cfg   Config
+}
+
+func NewManager(store Store, cfg Config) *Manager {
+	return &Manager{store: store, cfg: cfg}
+}
+
+// Create starts a session for user id and returns its tokens. Tokens are only
+// returned once they have been stored.
+func (m *Manager) Create(ctx context.Context, id int, meta Meta) (Tokens, error) {
+	for range saveAttempts {
+		sessionID, err := newID()
+		if err != nil {
+			return Tokens{}, err
+		}
+
+		now := time.Now()
+		s := Session{
+			ID:         sessionID,
+			UserID:     id,
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(m.cfg.AbsoluteTTL),
+			IP:         meta.IP,
+			UserAgent:  meta.UserAgent,
+		}
+		tokens, err := m.issue(&s, now)
+		if err != nil {
+			return Tokens{}, err
+		}
+
+		err = m.store.Save(ctx, s)
+		if errors.Is(err, ErrDuplicate) {
+			continue
+		}
+		if err != nil {
+			return Tokens{}, err
+		}
+		return tokens, nil
+	}
+
+	return Tokens{}, fmt.Errorf("create session: %w", ErrDuplicate)
+}
+
+// Validate returns the session owning access token and renews its idle
+// window. It returns ErrNotFound for unknown tokens and ErrExpired for tokens
+// that exist but are past their expiry. Refresh tokens are rejected.
+func (m *Manager) Validate(ctx context.Context, token string) (Session, error) {
+	if HasPrefix(token, RefreshTokenPrefix) {
+		return Session{}, ErrNotAccessToken
+	}
+	if !HasPrefix(token, AccessTokenPrefix) {
+		return Session{}, ErrNotFound
+	}
+
+	s, err := m.store.Get(ctx, HashToken(token))
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	if m.expired(s, now) || !now.Before(s.AccessExpiresAt) {
+		return Session{}, ErrExpired
+	}
+	return m.touch(ctx, s, now), nil
+}
+
+// ValidateID is Validate for access tokens that carry the session ID instead
+// of being stored, such as signed JWTs. The token's own expiry is checked by
+// the caller; this only checks that the session of userID hasn't been
+// revoked or expired.
+func (m *Manager) ValidateID(ctx context.Context, userID int, id string) (Session, error) {
+	s, err := m.store.GetByID(ctx, userID, id)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	if m.expired(s, now) {
+		return Session{}, ErrExpired
+	}
+	return m.touch(ctx, s, now), nil
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// A refresh token can be used once; presenting one that was already rotated
+// means it leaked, so the whole session is revoked and ErrRefreshReused is
+// returned.
+func (m *Manager) Refresh(ctx context.Context, token string) (Tokens, error) {
+	if !HasPrefix(token, RefreshTokenPrefix) {
+		return Tokens{}, ErrNotRefreshToken
+	}
+
+	refreshHash := HashToken(token)
+	s, err := m.store.GetByRefresh(ctx, refreshHash)
+	if errors.Is(err, ErrNotFound) {
+		return Tokens{}, m.checkReuse(ctx, refreshHash)
 	}
-	return key
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := time.Now()
+	if m.expired(s, now) {
+		return Tokens{}, ErrExpired
+	}
+
+	for range saveAttempts {
+		next := s
+		next.LastSeenAt = now
+		tokens, err := m.issue(&next, now)
+		if err != nil {
+			return Tokens{}, err
+		}
+
+		err = m.store.Rotate(ctx, refreshHash, next)
+		switch {
+		case errors.Is(err, ErrDuplicate):
+			continue
+		case errors.Is(err, ErrNotFound):
+			// Another request rotated this token first.
+			return Tokens{}, m.checkReuse(ctx, refreshHash)
+		case err != nil:
+			return Tokens{}, err
+		}
+		return tokens, nil
+	}
+
+	return Tokens{}, fmt.Errorf("refresh session: %w", ErrDuplicate)
+}
+
+// List returns the active sessions of a user.
+func (m *Manager) List(ctx context.Context, userID int) ([]Session, error) {
+	ss, err := m.store.List(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+
+	now := time.Now()
+	res := make([]Session, 0, len(ss))
+	for _, s := range ss {
+		if !m.expired(s, now) {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// Revoke ends the session with the given ID if it belongs to userID.
+func (m *Manager) Revoke(ctx context.Context, userID int, id string) error {
+	return m.store.Delete(ctx, userID, id)
+}
+
+// RevokeAll ends every session of userID.
+func (m *Manager) RevokeAll(ctx context.Context, userID int) error {
+	return m.store.DeleteUser(ctx, userID)
+}
+
+// Reap deletes expired sessions every interval until ctx is done.
+func (m *Manager) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := m.deleteExpired(ctx)
+			if err != nil {
+				slog.Error("failed to reap sessions", "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("reaped expired sessions", "count", n)
+			}
+		}
+	}
+}
+
+func (m *Manager) deleteExpired(ctx context.Context) (int, error) {
+	now := time.Now()
+	idleSince := time.Time{}
+	if m.cfg.IdleTTL > 0 {
+		idleSince = now.Add(-m.cfg.IdleTTL)
+	}
+	n, err := m.store.DeleteExpired(ctx, now, idleSince)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return n, nil
+}
+
+// issue generates a fresh token pair for s and records their hashes on it.
+func (m *Manager) issue(s *Session, now time.Time) (Tokens, error) {
+	access, err := NewToken(AccessTokenPrefix)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refresh, err := NewToken(RefreshTokenPrefix)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	s.AccessHash = HashToken(access)
+	s.RefreshHash = HashToken(refresh)
+	s.AccessExpiresAt = now.Add(m.cfg.AccessTTL)
+	if s.AccessExpiresAt.After(s.ExpiresAt) {
+		s.AccessExpiresAt = s.ExpiresAt
+	}
+
+	return Tokens{
+		UserID:           s.UserID,
+		SessionID:        s.ID,
+		AccessToken:      access,
+		AccessExpiresAt:  s.AccessExpiresAt,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: s.ExpiresAt,
+	}, nil
 }
 
-func Get(token string) (int, bool) {
-	m.Lock()
-	defer m.Unlock()
+// checkReuse revokes the session a rotated refresh token belonged to. It
+// returns ErrRefreshReused when that happened and ErrNotFound otherwise.
+func (m *Manager) checkReuse(ctx context.Context, refreshHash string) error {
+	userID, id, err := m.store.Rotated(ctx, refreshHash)
+	if errors.Is(err, ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
 
-	v, ok := sessionStore[token]
-	return v, ok
+	slog.Warn("refresh token reused, revoking session", "user_id", userID, "session_id", id)
+	if err := m.store.Delete(ctx, userID, id); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("revoke reused session: %w", err)
+	}
+	return ErrRefreshReused
 }
 
-func generate(n int) string {
-	chars := "0123456789abcdefghijklmnopqrstuvwxyz"
-	var sb strings.Builder
-	sb.Grow(n)
+// touch renews the idle window of s when it was last renewed a while ago.
+func (m *Manager) touch(ctx context.Context, s Session, now time.Time) Session {
+	if now.Sub(s.LastSeenAt) >= touchInterval {
+		if err := m.store.Touch(ctx, s.ID, now); err != nil {
+			slog.Error("failed to renew session", "user_id", s.UserID, "err", err)
+		}
+		s.LastSeenAt = now
+	}
+	return s
+}
 
-	for i := 0; i < n; i++ {
-		idx := rand.IntN(len(chars))
-		sb.WriteByte(chars[idx])
+func (m *Manager) expired(s Session, now time.Time) bool {
+	if !now.Before(s.ExpiresAt) {
+		return true
 	}
-	return sb.String()
+	return m.cfg.IdleTTL > 0 && now.Sub(s.LastSeenAt) >= m.cfg.IdleTTL
 }
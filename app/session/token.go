@@ -0,0 +1,50 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Token prefixes mark session tokens so that secret scanners can recognise
+// them when they leak into logs or repositories.
+const (
+	AccessTokenPrefix  = "tds_"
+	RefreshTokenPrefix = "tdr_"
+)
+
+// tokenBytes is the amount of randomness in a token (256 bits).
+const tokenBytes = 32
+
+// NewToken returns a random token carrying prefix. The caller must only ever
+// persist its hash, see HashToken.
+func NewToken(prefix string) (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 of token, which is what stores
+// keep in place of the token itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasPrefix reports whether token looks like one issued with prefix.
+func HasPrefix(token, prefix string) bool {
+	return strings.HasPrefix(token, prefix) && len(token) > len(prefix)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,177 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many attempts")
+	ErrAdminKey        = errors.New("invalid admin key")
+)
+
+// LockoutPolicy controls how failed logins slow down further attempts. Once
+// a key reaches its maximum, each further failure locks it for twice as long
+// as the previous one, starting at BaseLockout and capped at MaxLockout.
+type LockoutPolicy struct {
+	// MaxAccountAttempts and MaxIPAttempts are the failures tolerated per
+	// email address and per client IP before locking.
+	MaxAccountAttempts int
+	MaxIPAttempts      int
+	BaseLockout        time.Duration
+	MaxLockout         time.Duration
+	// Window forgets failures older than this when nothing is locked.
+	Window time.Duration
+}
+
+// lockedError carries when a locked login key opens again.
+type lockedError struct {
+	until time.Time
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("%s, try again after %s", ErrTooManyAttempts, e.until.Format(time.DateTime))
+}
+
+func (e *lockedError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+func accountKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// resetKey and resetIPKey count password reset requests apart from logins.
+func resetKey(email string) string {
+	return "reset:" + accountKey(email)
+}
+
+func resetIPKey(ip string) string {
+	return "reset:" + ipKey(ip)
+}
+
+// checkLocked returns a lockedError if any of keys is locked right now.
+func (s *Service) checkLocked(ctx context.Context, keys ...string) error {
+	repo := repository.New(s.db)
+	now := time.Now()
+	for _, key := range keys {
+		a := repo.CheckLoginAttempt(ctx, key)
+		if a != nil && a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+			return &lockedError{until: *a.LockedUntil}
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failed login, or another throttled request, against
+// key and locks it once max is reached.
+func (s *Service) recordFailure(ctx context.Context, key string, max int) error {
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		now := time.Now()
+
+		failures := 1
+		if a := r.CheckLoginAttempt(ctx, key); a != nil {
+			stale := now.Sub(a.LastFailedAt) > s.cfg.Lockout.Window
+			locked := a.LockedUntil != nil && now.Before(*a.LockedUntil)
+			if !stale || locked {
+				failures = a.Failures + 1
+			}
+		}
+
+		var lockedUntil *time.Time
+		if failures >= max {
+			until := now.Add(s.lockoutFor(failures - max))
+			lockedUntil = &until
+		}
+
+		return r.SaveLoginAttempt(ctx, repository.LoginAttempt{
+			AttemptKey:   key,
+			Failures:     failures,
+			LastFailedAt: now,
+			LockedUntil:  lockedUntil,
+		})
+	})
+}
+
+// lockoutFor returns the lock duration after excess failures past the limit.
+func (s *Service) lockoutFor(excess int) time.Duration {
+	p := s.cfg.Lockout
+	d := float64(p.BaseLockout) * math.Pow(2, float64(excess))
+	if d > float64(p.MaxLockout) {
+		return p.MaxLockout
+	}
+	return time.Duration(d)
+}
+
+// Unlock clears the failed login count and lock of an account.
+func (s *Service) Unlock(ctx context.Context, email string) error {
+	return repository.New(s.db).DeleteLoginAttempt(ctx, accountKey(email))
+}
+
+// RequireAdminKey guards operator endpoints with the configured admin key,
+// sent in the X-Admin-Key header. Without a configured key they are closed.
+func (s *Service) RequireAdminKey(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Admin-Key")
+		if s.cfg.AdminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(s.cfg.AdminKey)) != 1 {
+			server.ErrorResponse(w, http.StatusForbidden, ErrAdminKey)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Service) HandleUnlock() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Email string `json:"email"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.Unlock(r.Context(), input.Email)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// loginErrorResponse writes the response for a failed login. Unknown emails
+// and wrong passwords share one answer.
+func loginErrorResponse(w http.ResponseWriter, err error) {
+	var locked *lockedError
+	switch {
+	case errors.As(err, &locked):
+		retry := int(math.Ceil(time.Until(locked.until).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+		server.ErrorResponse(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, ErrInvalidLogin):
+		server.ErrorResponse(w, http.StatusUnauthorized, ErrInvalidLogin)
+	case errors.Is(err, ErrAccountDisabled):
+		server.ErrorResponse(w, http.StatusForbidden, err)
+	default:
+		server.ErrorResponse(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,362 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/session"
+	"github.com/febriW/be-to-do/totp"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeMFA = "mfa-login"
+	// mfaChallengeTTL is how long the second login step may take.
+	mfaChallengeTTL = 5 * time.Minute
+	// totpSkew accepts codes one step either side of the server clock.
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	// totpIssuer names the account in authenticator apps.
+	totpIssuer = "be-to-do"
+)
+
+var (
+	ErrMFAEnabled     = errors.New("two-factor authentication already enabled")
+	ErrMFANotEnrolled = errors.New("two-factor authentication not enrolled")
+	ErrInvalidCode    = errors.New("invalid authentication code")
+)
+
+type Enrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI to render as a QR code.
+	URI string `json:"uri"`
+}
+
+// EnrollTOTP starts two-factor enrollment for user id with a new secret. The
+// secret takes effect once confirmed with ConfirmTOTP.
+func (s *Service) EnrollTOTP(ctx context.Context, id int) (Enrollment, error) {
+	repo := repository.New(s.db)
+	u := repo.CheckUserByID(ctx, id)
+	if u == nil {
+		return Enrollment{}, fmt.Errorf("user %d %w", id, ErrNotFound)
+	}
+	if u.TOTPEnabledAt != nil {
+		return Enrollment{}, ErrMFAEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if err := repo.UpdateUserTOTP(ctx, id, &secret); err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{Secret: secret, URI: totp.URI(totpIssuer, u.Email, secret)}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// app produces valid codes, and returns single-use recovery codes. The codes
+// are not stored in plain text and can't be shown again.
+func (s *Service) ConfirmTOTP(ctx context.Context, id int, code string) ([]string, error) {
+	var codes []string
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		if u.TOTPEnabledAt != nil {
+			return ErrMFAEnabled
+		}
+		if u.TOTPSecret == nil {
+			return ErrMFANotEnrolled
+		}
+
+		step, ok := totp.Validate(*u.TOTPSecret, code, time.Now(), totpSkew, 0)
+		if !ok {
+			return ErrInvalidCode
+		}
+		if err := r.EnableUserTOTP(ctx, id, time.Now(), step); err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		if err := r.DeleteRecoveryCodes(ctx, id); err != nil {
+			return err
+		}
+		for _, c := range codes {
+			if err := r.CreateRecoveryCode(ctx, id, session.HashToken(c)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return codes, err
+}
+
+// LoginMFA completes a login challenged by Login with a TOTP code or an
+// unused recovery code.
+func (s *Service) LoginMFA(ctx context.Context, mfaToken, code string, meta session.Meta) (LoginResult, error) {
+	id, email, err := s.verifySigned(purposeMFA, mfaToken, time.Now())
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if err := s.checkLocked(ctx, accountKey(email), ipKey(meta.IP)); err != nil {
+		return LoginResult{}, err
+	}
+
+	err = s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil || u.TOTPEnabledAt == nil || u.TOTPSecret == nil {
+			return ErrMFANotEnrolled
+		}
+
+		after := int64(0)
+		if u.TOTPLastStep != nil {
+			after = *u.TOTPLastStep
+		}
+		if step, ok := totp.Validate(*u.TOTPSecret, code, time.Now(), totpSkew, after); ok {
+			return r.UpdateUserTOTPStep(ctx, id, step)
+		}
+
+		n, err := r.UseRecoveryCode(ctx, id, session.HashToken(normalizeRecoveryCode(code)), time.Now())
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	})
+	if errors.Is(err, ErrInvalidCode) {
+		if err := s.loginFailed(ctx, email, meta); err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{}, ErrInvalidCode
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	tokens, err := s.startSession(ctx, id, meta)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{AuthorID: id, Tokens: tokens}, nil
+}
+
+// DisableTOTP turns two-factor authentication off for user id and deletes
+// the recovery codes. The user confirms with the password, see confirmUser.
+func (s *Service) DisableTOTP(ctx context.Context, id int, sessionID, password string) error {
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		if err := s.confirmUser(ctx, u, sessionID, password); err != nil {
+			return err
+		}
+		return clearTOTP(ctx, r, u)
+	})
+}
+
+// ResetTOTP turns two-factor authentication off for user id without asking
+// the user, so that an administrator can let back in someone who lost both
+// the authenticator and the recovery codes.
+func (s *Service) ResetTOTP(ctx context.Context, id int) error {
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		return clearTOTP(ctx, r, u)
+	})
+}
+
+// clearTOTP removes the secret, including one still being enrolled, and the
+// recovery codes of u.
+func clearTOTP(ctx context.Context, r *repository.Repository, u *repository.User) error {
+	if u.TOTPSecret == nil && u.TOTPEnabledAt == nil {
+		return ErrMFANotEnrolled
+	}
+	if err := r.UpdateUserTOTP(ctx, u.ID, nil); err != nil {
+		return err
+	}
+	return r.DeleteRecoveryCodes(ctx, u.ID)
+}
+
+func (s *Service) HandleEnrollTOTP() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, err := s.EnrollTOTP(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrMFAEnabled) {
+				status = http.StatusConflict
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, e)
+	}
+}
+
+func (s *Service) HandleConfirmTOTP() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Code string `json:"code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		codes, err := s.ConfirmTOTP(r.Context(), IDFromContext(r.Context()), input.Code)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrMFAEnabled):
+				status = http.StatusConflict
+			case errors.Is(err, ErrMFANotEnrolled), errors.Is(err, ErrInvalidCode):
+				status = http.StatusUnprocessableEntity
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{
+			RecoveryCodes: codes,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) HandleLoginMFA() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := s.LoginMFA(r.Context(), input.MFAToken, input.Code, sessionMeta(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidSignature),
+				errors.Is(err, ErrInvalidCode),
+				errors.Is(err, ErrMFANotEnrolled):
+				server.ErrorResponse(w, http.StatusUnauthorized, err)
+			default:
+				loginErrorResponse(w, err)
+			}
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, mapTokens(res.AuthorID, res.Tokens))
+	}
+}
+
+func (s *Service) HandleDisableTOTP() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Password string `json:"password"`
+		}
+
+		// Accounts without a password may leave the body out.
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil && !errors.Is(err, io.EOF) {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx := r.Context()
+		err = s.DisableTOTP(ctx, IDFromContext(ctx), sessionIDFromContext(ctx), input.Password)
+		if err != nil {
+			totpErrorResponse(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) HandleResetTOTP() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.ResetTOTP(r.Context(), id)
+		if err != nil {
+			totpErrorResponse(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func totpErrorResponse(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrWrongPassword), errors.Is(err, ErrReauthRequired):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrMFANotEnrolled):
+		status = http.StatusUnprocessableEntity
+	}
+	server.ErrorResponse(w, status, err)
+}
+
+// newRecoveryCodes returns codes of the form xxxxx-xxxxx, 50 random bits each.
+func newRecoveryCodes() ([]string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		c := strings.ToLower(enc.EncodeToString(b))[:10]
+		codes = append(codes, c[:5]+"-"+c[5:])
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) == 10 && !strings.Contains(code, "-") {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
@@ -0,0 +1,286 @@
+package user
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/session"
+	"github.com/febriW/be-to-do/totp"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+var (
+	updateTOTPStep  = regexp.QuoteMeta("UPDATE user SET totp_last_step = ? WHERE id = ?")
+	useRecoveryCode = regexp.QuoteMeta("UPDATE recovery_code SET used_at = ?")
+)
+
+// mfaUserRow returns user 3 with testTOTPSecret, enabled unless enabledAt is
+// nil. lastStep is the last TOTP step used, or nil.
+func mfaUserRow(enabledAt *time.Time, lastStep driver.Value) *sqlmock.Rows {
+	var enabled driver.Value
+	if enabledAt != nil {
+		enabled = *enabledAt
+	}
+	return sqlmock.NewRows([]string{"id", "email", "totp_secret", "totp_enabled_at", "totp_last_step"}).
+		AddRow(3, "someone@example.com", testTOTPSecret, enabled, lastStep)
+}
+
+func currentCode(t *testing.T) (string, int64) {
+	t.Helper()
+
+	step := totp.Step(time.Now())
+	code, err := totp.Code(testTOTPSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, step
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wrong code", func(t *testing.T) {
+		s, mock := newTestService(t, Config{})
+		code, _ := currentCode(t)
+		wrong := "000000"
+		if code == wrong {
+			wrong = "111111"
+		}
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(nil, nil))
+		mock.ExpectRollback()
+
+		if _, err := s.ConfirmTOTP(ctx, 3, wrong); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidCode)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("valid code", func(t *testing.T) {
+		s, mock := newTestService(t, Config{})
+		code, _ := currentCode(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(nil, nil))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET totp_enabled_at = ?, totp_last_step = ?")).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM recovery_code")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+		for range recoveryCodeCount {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO recovery_code")).WithArgs(3, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		codes, err := s.ConfirmTOTP(ctx, 3, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != recoveryCodeCount {
+			t.Errorf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestLoginMFA(t *testing.T) {
+	s, mock := newTestService(t, Config{Lockout: testLockout})
+	ctx := context.Background()
+	meta := session.Meta{IP: "192.0.2.1"}
+	enabledAt := time.Now().Add(-24 * time.Hour)
+	mfaToken := s.sign(purposeMFA, 3, "someone@example.com", time.Now().Add(mfaChallengeTTL))
+	code, step := currentCode(t)
+
+	// expectLogin expects a login that gets past the second factor to start
+	// a session.
+	expectLogin := func() {
+		mock.ExpectCommit()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(&enabledAt, step))
+	}
+	// expectRefused expects a refused code to count as a failed login.
+	expectRefused := func() {
+		mock.ExpectRollback()
+		expectFirstFailure(mock, "email:someone@example.com", "ip:192.0.2.1")
+	}
+
+	t.Run("valid code", func(t *testing.T) {
+		expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(&enabledAt, nil))
+		mock.ExpectExec(updateTOTPStep).WithArgs(step, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLogin()
+
+		res, err := s.LoginMFA(ctx, mfaToken, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Tokens.AccessToken == "" {
+			t.Error("no session started")
+		}
+	})
+
+	t.Run("replayed code", func(t *testing.T) {
+		expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(&enabledAt, step))
+		mock.ExpectExec(useRecoveryCode).WithArgs(sqlmock.AnyArg(), 3, session.HashToken(code)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectRefused()
+
+		if _, err := s.LoginMFA(ctx, mfaToken, code, meta); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidCode)
+		}
+	})
+
+	t.Run("recovery code", func(t *testing.T) {
+		expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(&enabledAt, step))
+		mock.ExpectExec(useRecoveryCode).WithArgs(sqlmock.AnyArg(), 3, session.HashToken("abcde-fghij")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLogin()
+
+		if _, err := s.LoginMFA(ctx, mfaToken, "ABCDEFGHIJ", meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("spent recovery code", func(t *testing.T) {
+		expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(mfaUserRow(&enabledAt, step))
+		mock.ExpectExec(useRecoveryCode).WithArgs(sqlmock.AnyArg(), 3, session.HashToken("abcde-fghij")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectRefused()
+
+		if _, err := s.LoginMFA(ctx, mfaToken, "abcde-fghij", meta); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidCode)
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		expired := s.sign(purposeMFA, 3, "someone@example.com", time.Now().Add(-time.Second))
+		if _, err := s.LoginMFA(ctx, expired, code, meta); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidSignature)
+		}
+	})
+
+	t.Run("token for another purpose", func(t *testing.T) {
+		other := s.sign(purposeVerify, 3, "someone@example.com", time.Now().Add(mfaChallengeTTL))
+		if _, err := s.LoginMFA(ctx, other, code, meta); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidSignature)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleDisableTOTP(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("current password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabledAt := time.Now().Add(-24 * time.Hour)
+	account := func(secret, enabledAt driver.Value) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "password_hash", "totp_secret", "totp_enabled_at"}).
+			AddRow(3, string(hash), secret, enabledAt)
+	}
+	expectCleared := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET totp_secret = ?, totp_enabled_at = NULL, totp_last_step = NULL")).
+			WithArgs(nil, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM recovery_code")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 9))
+		mock.ExpectCommit()
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "password",
+			body: `{"password": "current password"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(testTOTPSecret, enabledAt))
+				expectCleared(mock)
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name: "wrong password",
+			body: `{"password": "guess"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(testTOTPSecret, enabledAt))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "no password",
+			body: "",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(testTOTPSecret, enabledAt))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "not enrolled",
+			body: `{"password": "current password"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(nil, nil))
+				mock.ExpectRollback()
+			},
+			status: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+			mock.ExpectBegin()
+			tt.expect(mock)
+
+			req := httptest.NewRequest(http.MethodDelete, "/auth/totp", strings.NewReader(tt.body))
+			ctx := NewContext(req.Context(), 3, "")
+			req = req.WithContext(context.WithValue(ctx, sessionCtxKey{}, "current"))
+			rec := httptest.NewRecorder()
+			s.HandleDisableTOTP()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("reset by an administrator", func(t *testing.T) {
+		s, mock := newTestService(t, Config{})
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(testTOTPSecret, enabledAt))
+		expectCleared(mock)
+
+		if err := s.ResetTOTP(context.Background(), 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
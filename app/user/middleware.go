@@ -2,32 +2,122 @@ package user
 
 import (
 	"context"
+	"fmt"
+	"github.com/febriW/be-to-do/jwt"
+	"github.com/febriW/be-to-do/server"
 	"github.com/febriW/be-to-do/session"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type tokenCtxKey struct{}
 
-func TokenMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+type sessionCtxKey struct{}
+
+type scopesCtxKey struct{}
+
+// principal is who a request is authenticated as.
+type principal struct {
+	userID int
+	// sessionID is empty for personal access tokens.
+	sessionID string
+	// scopes is nil for session tokens, which may do anything the user can.
+	scopes []string
+}
+
+func (s *Service) TokenMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 		if token == "" {
-			w.WriteHeader(http.StatusUnauthorized)
+			server.ErrorResponse(w, http.StatusUnauthorized, ErrMissingToken)
 			return
 		}
 
 		token = strings.TrimPrefix(token, "Bearer ")
-		id, ok := session.Get(token)
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+		p, err := s.authenticate(r.Context(), token)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnauthorized, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), tokenCtxKey{}, id)
+		ctx := context.WithValue(r.Context(), tokenCtxKey{}, p.userID)
+		ctx = context.WithValue(ctx, sessionCtxKey{}, p.sessionID)
+		ctx = context.WithValue(ctx, scopesCtxKey{}, p.scopes)
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// RequireScope rejects requests made with a personal access token that was
+// not granted scope. Session tokens pass. It must run inside TokenMiddleware.
+func RequireScope(scope string, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopes, _ := r.Context().Value(scopesCtxKey{}).([]string)
+		if scopes != nil && !slices.Contains(scopes, scope) {
+			server.ErrorResponse(w, http.StatusForbidden, fmt.Errorf("scope %s %w", scope, ErrInsufficientScope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireSession rejects requests not made with a session token, keeping
+// personal access tokens away from account management. It must run inside
+// TokenMiddleware.
+func RequireSession(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sessionIDFromContext(r.Context()) == "" {
+			server.ErrorResponse(w, http.StatusForbidden, ErrSessionRequired)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticate resolves a bearer token to the user it belongs to. Personal
+// access tokens are looked up by prefix; access tokens are verified as JWTs
+// or looked up in the session store depending on the mode. Either way the
+// session must still be in the store.
+func (s *Service) authenticate(ctx context.Context, token string) (principal, error) {
+	if session.HasPrefix(token, TokenPrefix) {
+		t, err := s.validateToken(ctx, token)
+		if err != nil {
+			return principal{}, err
+		}
+		scopes := strings.Fields(t.Scopes)
+		if scopes == nil {
+			scopes = []string{}
+		}
+		return principal{userID: t.UserID, scopes: scopes}, nil
+	}
+
+	if s.cfg.JWT == nil {
+		sess, err := s.sessions.Validate(ctx, token)
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{userID: sess.UserID, sessionID: sess.ID}, nil
+	}
+
+	claims, err := s.cfg.JWT.Verify(token, time.Now())
+	if err != nil {
+		return principal{}, err
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil || id <= 0 || claims.SessionID == "" {
+		return principal{}, jwt.ErrInvalid
+	}
+
+	// A valid signature only proves the token was issued; logging out,
+	// disabling and deleting the account end the session it was issued for.
+	sess, err := s.sessions.ValidateID(ctx, id, claims.SessionID)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{userID: sess.UserID, sessionID: sess.ID}, nil
+}
+
 func IDFromContext(ctx context.Context) int {
 	v, ok := ctx.Value(tokenCtxKey{}).(int)
 	if !ok {
@@ -35,3 +125,24 @@ func IDFromContext(ctx context.Context) int {
 	}
 	return v
 }
+
+// NewContext returns ctx authenticated as user id with role, the way
+// TokenMiddleware and RequireRole leave a request. An empty role is what
+// handlers see outside RequireRole.
+//
+// It is the supported way to call services that act for the authenticated
+// user, such as card.Service, without going through HTTP: from jobs, tools
+// or tests of other packages. The context carries no session, so anything
+// behind RequireSession refuses it.
+func NewContext(ctx context.Context, id int, role string) context.Context {
+	ctx = context.WithValue(ctx, tokenCtxKey{}, id)
+	if role != "" {
+		ctx = context.WithValue(ctx, roleCtxKey{}, role)
+	}
+	return ctx
+}
+
+func sessionIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(sessionCtxKey{}).(string)
+	return v
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github.com/febriW/be-to-do/jwt"
+	"github.com/febriW/be-to-do/session"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateJWT(t *testing.T) {
+	key, err := jwt.NewHS256Key("test", []byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.NewKeySet("", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestService(t, Config{JWT: keys})
+	ctx := context.Background()
+
+	tokens, err := s.sessions.Create(ctx, 3, session.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = s.signAccessToken(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.authenticate(ctx, tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.userID != 3 || p.sessionID != tokens.SessionID {
+		t.Errorf("authenticated as user %d session %s, want user 3 session %s", p.userID, p.sessionID, tokens.SessionID)
+	}
+
+	t.Run("without session", func(t *testing.T) {
+		token, err := keys.Sign(jwt.Claims{Subject: "3", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.authenticate(ctx, token); !errors.Is(err, jwt.ErrInvalid) {
+			t.Fatalf("err %v, want %v", err, jwt.ErrInvalid)
+		}
+	})
+
+	t.Run("session of another user", func(t *testing.T) {
+		token, err := keys.Sign(jwt.Claims{Subject: "4", ExpiresAt: time.Now().Add(time.Minute).Unix(), SessionID: tokens.SessionID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.authenticate(ctx, token); !errors.Is(err, session.ErrNotFound) {
+			t.Fatalf("err %v, want %v", err, session.ErrNotFound)
+		}
+	})
+
+	t.Run("revoked session", func(t *testing.T) {
+		if err := s.sessions.RevokeAll(ctx, 3); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.authenticate(ctx, tokens.AccessToken); !errors.Is(err, session.ErrNotFound) {
+			t.Fatalf("err %v, want %v", err, session.ErrNotFound)
+		}
+	})
+}
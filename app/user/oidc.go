@@ -0,0 +1,205 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/oidc"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/session"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	purposeOIDC = "oidc-login"
+	// oidcCookie carries the signed login challenge between the redirect to
+	// the provider and the callback.
+	oidcCookie = "oidc_login"
+	// oidcLoginTTL is how long the user may take at the provider.
+	oidcLoginTTL = 10 * time.Minute
+)
+
+var (
+	ErrOIDCState          = errors.New("invalid or expired login state")
+	ErrUnverifiedIdentity = errors.New("identity provider didn't confirm a verified email")
+	// ErrUnverifiedAccount refuses to link a provider identity to a local
+	// account whose email was never confirmed. Whoever registered it may not
+	// own the address, and linking would hand them the provider's login.
+	ErrUnverifiedAccount = errors.New("an unverified account already uses this email, verify it before logging in with the identity provider")
+)
+
+// LoginOIDC signs in the user behind verified provider claims. An identity
+// seen before logs into its linked account; a new one is linked to the
+// verified account with the same email, or to a new account if none exists.
+func (s *Service) LoginOIDC(ctx context.Context, claims oidc.Claims, meta session.Meta) (LoginResult, error) {
+	var u *repository.User
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		if identity := r.CheckUserIdentity(ctx, claims.Issuer, claims.Subject); identity != nil {
+			u = r.CheckUserByID(ctx, identity.UserID)
+			if u == nil {
+				return fmt.Errorf("user %d %w", identity.UserID, ErrNotFound)
+			}
+			return nil
+		}
+
+		if claims.Email == "" || !claims.EmailVerified {
+			return ErrUnverifiedIdentity
+		}
+
+		u = r.CheckUser(ctx, claims.Email)
+		if u == nil {
+			id, err := s.createExternalUser(ctx, r, claims, time.Now())
+			if err != nil {
+				return err
+			}
+			u = r.CheckUserByID(ctx, id)
+			if u == nil {
+				return fmt.Errorf("user %d %w", id, ErrNotFound)
+			}
+		} else if u.VerifiedAt == nil {
+			return fmt.Errorf("email %s: %w", u.Email, ErrUnverifiedAccount)
+		}
+
+		return r.CreateUserIdentity(ctx, repository.UserIdentity{
+			UserID:  u.ID,
+			Issuer:  claims.Issuer,
+			Subject: claims.Subject,
+			Email:   claims.Email,
+		})
+	})
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	// The provider vouches for the password step only; accounts with
+	// two-factor authentication still complete the challenge.
+	if u.TOTPEnabledAt != nil {
+		return LoginResult{
+			AuthorID: u.ID,
+			MFAToken: s.sign(purposeMFA, u.ID, u.Email, time.Now().Add(mfaChallengeTTL)),
+		}, nil
+	}
+
+	tokens, err := s.startSession(ctx, u.ID, meta)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{AuthorID: u.ID, Tokens: tokens}, nil
+}
+
+// createExternalUser registers an account for a provider identity. It has no
+// password, so only the provider can log into it until the password reset
+// flow sets one.
+func (s *Service) createExternalUser(ctx context.Context, r *repository.Repository, claims oidc.Claims, now time.Time) (int, error) {
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+	return r.CreateUser(ctx, repository.User{
+		Name:       name,
+		Email:      claims.Email,
+		VerifiedAt: &now,
+	})
+}
+
+func (s *Service) HandleOIDCLogin() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := oidc.NewChallenge()
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		authURL, err := s.cfg.OIDC.AuthCodeURL(r.Context(), c)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadGateway, err)
+			return
+		}
+
+		value := strings.Join([]string{c.State, c.Nonce, c.Verifier}, ".")
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    s.sign(purposeOIDC, 0, value, time.Now().Add(oidcLoginTTL)),
+			Path:     "/auth/oidc",
+			MaxAge:   int(oidcLoginTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || strings.HasPrefix(s.cfg.BaseURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func (s *Service) HandleOIDCCallback() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/auth/oidc", MaxAge: -1})
+
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			server.ErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("identity provider: %s", e))
+			return
+		}
+
+		c, err := s.oidcChallenge(r, query.Get("state"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		claims, err := s.cfg.OIDC.Exchange(r.Context(), query.Get("code"), c)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		res, err := s.LoginOIDC(r.Context(), claims, sessionMeta(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrUnverifiedIdentity) || errors.Is(err, ErrAccountDisabled):
+				status = http.StatusForbidden
+			case errors.Is(err, ErrUnverifiedAccount):
+				status = http.StatusConflict
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		if res.MFAToken != "" {
+			output := struct {
+				MFARequired bool   `json:"mfa_required"`
+				MFAToken    string `json:"mfa_token"`
+			}{
+				MFARequired: true,
+				MFAToken:    res.MFAToken,
+			}
+			server.JSONResponse(w, http.StatusOK, output)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, mapTokens(res.AuthorID, res.Tokens))
+	}
+}
+
+// oidcChallenge recovers the challenge from the login cookie and checks it
+// was issued for state.
+func (s *Service) oidcChallenge(r *http.Request, state string) (oidc.Challenge, error) {
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return oidc.Challenge{}, ErrOIDCState
+	}
+
+	_, value, err := s.verifySigned(purposeOIDC, cookie.Value, time.Now())
+	if err != nil {
+		return oidc.Challenge{}, ErrOIDCState
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || state == "" || parts[0] != state {
+		return oidc.Challenge{}, ErrOIDCState
+	}
+	return oidc.Challenge{State: parts[0], Nonce: parts[1], Verifier: parts[2]}, nil
+}
@@ -0,0 +1,369 @@
+package user
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/oidc"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID    = "be-to-do"
+	testRedirectURL = "http://app.test/auth/oidc/callback"
+)
+
+// testIdentity is who the stand-in provider says logged in.
+type testIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// testProvider is a minimal OpenID provider: it hands out a code for every
+// authorization request and trades it for an RS256 ID token, enforcing PKCE.
+type testProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	identity testIdentity
+
+	m     sync.Mutex
+	codes map[string]testGrant
+}
+
+type testGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newTestProvider(t *testing.T, identity testIdentity) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, identity: identity, codes: map[string]testGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	p.m.Lock()
+	code := "code-" + strconv.Itoa(len(p.codes))
+	p.codes[code] = testGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	p.m.Unlock()
+
+	v := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+}
+
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.m.Lock()
+	grant, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.m.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	writeJSON(w, map[string]string{"id_token": p.sign(map[string]any{
+		"iss":            p.URL,
+		"sub":            p.identity.Subject,
+		"aud":            testClientID,
+		"exp":            now.Add(time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          grant.nonce,
+		"email":          p.identity.Email,
+		"email_verified": p.identity.EmailVerified,
+		"name":           p.identity.Name,
+	})})
+}
+
+func (p *testProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newOIDCTestService(t *testing.T, p *testProvider) (*Service, sqlmock.Sqlmock) {
+	t.Helper()
+
+	return newTestService(t, Config{
+		OIDC: oidc.NewProvider(oidc.Config{
+			Issuer:       p.URL,
+			ClientID:     testClientID,
+			ClientSecret: "secret",
+			RedirectURL:  testRedirectURL,
+		}),
+	})
+}
+
+// startOIDCLogin runs /auth/oidc/login and returns the login cookie and the
+// provider URL the user is sent to.
+func startOIDCLogin(t *testing.T, s *Service) (*http.Cookie, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.HandleOIDCLogin()(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookie {
+		t.Fatalf("login: cookies %v", cookies)
+	}
+	return cookies[0], rec.Header().Get("Location")
+}
+
+// authorize follows authURL at the provider and returns the callback URL it
+// redirects back to.
+func authorize(t *testing.T, authURL string) string {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func callback(s *Service, callbackURL string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, callbackURL, nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	s.HandleOIDCCallback()(rec, req)
+	return rec
+}
+
+var (
+	queryIdentity   = regexp.QuoteMeta("FROM user_identity WHERE issuer = ? AND subject = ?")
+	insertUser      = regexp.QuoteMeta("INSERT INTO user ")
+	insertIdentity  = regexp.QuoteMeta("INSERT INTO user_identity ")
+	identityColumns = []string{"id", "user_id", "issuer", "subject", "email"}
+)
+
+func TestOIDCLogin(t *testing.T) {
+	verifiedAt := time.Now().Add(-24 * time.Hour)
+
+	tests := []struct {
+		name     string
+		identity testIdentity
+		expect   func(mock sqlmock.Sqlmock, issuer string)
+		status   int
+		authorID int
+	}{
+		{
+			name:     "new user",
+			identity: testIdentity{Subject: "sub-1", Email: "new@example.com", EmailVerified: true, Name: "New"},
+			expect: func(mock sqlmock.Sqlmock, issuer string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryIdentity).WithArgs(issuer, "sub-1").WillReturnRows(sqlmock.NewRows(identityColumns))
+				mock.ExpectQuery(queryUserEmail).WithArgs("new@example.com").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectExec(insertUser).WithArgs("New", "new@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectQuery(queryUserID).WithArgs(7).WillReturnRows(userRow(7, "new@example.com", &verifiedAt))
+				mock.ExpectExec(insertIdentity).WithArgs(7, issuer, "sub-1", "new@example.com").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(queryUserID).WithArgs(7).WillReturnRows(userRow(7, "new@example.com", &verifiedAt))
+			},
+			status:   http.StatusOK,
+			authorID: 7,
+		},
+		{
+			name:     "links verified account",
+			identity: testIdentity{Subject: "sub-2", Email: "known@example.com", EmailVerified: true},
+			expect: func(mock sqlmock.Sqlmock, issuer string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryIdentity).WithArgs(issuer, "sub-2").WillReturnRows(sqlmock.NewRows(identityColumns))
+				mock.ExpectQuery(queryUserEmail).WithArgs("known@example.com").
+					WillReturnRows(userRow(3, "known@example.com", &verifiedAt))
+				mock.ExpectExec(insertIdentity).WithArgs(3, issuer, "sub-2", "known@example.com").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(userRow(3, "known@example.com", &verifiedAt))
+			},
+			status:   http.StatusOK,
+			authorID: 3,
+		},
+		{
+			name:     "linked identity",
+			identity: testIdentity{Subject: "sub-3", Email: "changed@example.com", EmailVerified: false},
+			expect: func(mock sqlmock.Sqlmock, issuer string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryIdentity).WithArgs(issuer, "sub-3").
+					WillReturnRows(sqlmock.NewRows(identityColumns).AddRow(1, 5, issuer, "sub-3", "old@example.com"))
+				mock.ExpectQuery(queryUserID).WithArgs(5).WillReturnRows(userRow(5, "old@example.com", &verifiedAt))
+				mock.ExpectCommit()
+				mock.ExpectQuery(queryUserID).WithArgs(5).WillReturnRows(userRow(5, "old@example.com", &verifiedAt))
+			},
+			status:   http.StatusOK,
+			authorID: 5,
+		},
+		{
+			name:     "refuses unverified account",
+			identity: testIdentity{Subject: "sub-4", Email: "victim@example.com", EmailVerified: true},
+			expect: func(mock sqlmock.Sqlmock, issuer string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryIdentity).WithArgs(issuer, "sub-4").WillReturnRows(sqlmock.NewRows(identityColumns))
+				mock.ExpectQuery(queryUserEmail).WithArgs("victim@example.com").
+					WillReturnRows(userRow(9, "victim@example.com", nil))
+				mock.ExpectRollback()
+			},
+			status: http.StatusConflict,
+		},
+		{
+			name:     "unverified email claim",
+			identity: testIdentity{Subject: "sub-5", Email: "claimed@example.com", EmailVerified: false},
+			expect: func(mock sqlmock.Sqlmock, issuer string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryIdentity).WithArgs(issuer, "sub-5").WillReturnRows(sqlmock.NewRows(identityColumns))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, tt.identity)
+			s, mock := newOIDCTestService(t, p)
+			tt.expect(mock, p.URL)
+
+			cookie, authURL := startOIDCLogin(t, s)
+			rec := callback(s, authorize(t, authURL), cookie)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusOK {
+				var tokens Tokens
+				if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+					t.Fatal(err)
+				}
+				if tokens.AuthorID != tt.authorID || tokens.Token == "" || tokens.RefreshToken == "" {
+					t.Errorf("tokens %+v, want a session for user %d", tokens, tt.authorID)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsForgedLogin(t *testing.T) {
+	p := newTestProvider(t, testIdentity{Subject: "sub", Email: "user@example.com", EmailVerified: true})
+	s, mock := newOIDCTestService(t, p)
+
+	t.Run("state mismatch", func(t *testing.T) {
+		cookie, _ := startOIDCLogin(t, s)
+		_, otherURL := startOIDCLogin(t, s)
+
+		// The callback carries the state of a login this browser didn't start.
+		rec := callback(s, authorize(t, otherURL), cookie)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+		}
+	})
+
+	t.Run("missing cookie", func(t *testing.T) {
+		_, authURL := startOIDCLogin(t, s)
+
+		rec := httptest.NewRecorder()
+		s.HandleOIDCCallback()(rec, httptest.NewRequest(http.MethodGet, authorize(t, authURL), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+		}
+	})
+
+	t.Run("PKCE mismatch", func(t *testing.T) {
+		cookie, authURL := startOIDCLogin(t, s)
+		_, otherURL := startOIDCLogin(t, s)
+
+		// An injected code was issued for another login's challenge; only
+		// the state is made to match this browser's cookie.
+		state, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		injected, err := url.Parse(otherURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := injected.Query()
+		q.Set("state", state.Query().Get("state"))
+		injected.RawQuery = q.Encode()
+
+		rec := callback(s, authorize(t, injected.String()), cookie)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
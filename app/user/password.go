@@ -0,0 +1,291 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/session"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ResetTokenPrefix marks password reset tokens for secret scanners.
+const ResetTokenPrefix = "tdpw_"
+
+var (
+	ErrInvalidReset  = errors.New("invalid or expired reset token")
+	ErrEmptyPassword = errors.New("password can't be empty")
+	ErrWrongPassword = errors.New("current password is incorrect")
+)
+
+// ForgotPassword mails a reset link to email if it belongs to an account.
+// The lookup and the mail happen in the background, so that callers can't
+// probe for accounts by the answer or by how long it takes. Requests are
+// throttled per email and per client IP like failed logins, so the endpoint
+// can't flood an inbox.
+func (s *Service) ForgotPassword(ctx context.Context, email string, meta session.Meta) error {
+	if err := s.checkLocked(ctx, resetKey(email), resetIPKey(meta.IP)); err != nil {
+		return err
+	}
+	err := errors.Join(
+		s.recordFailure(ctx, resetKey(email), s.cfg.Lockout.MaxAccountAttempts),
+		s.recordFailure(ctx, resetIPKey(meta.IP), s.cfg.Lockout.MaxIPAttempts),
+	)
+	if err != nil {
+		return fmt.Errorf("error when recording reset request: %w", err)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.sendPasswordReset(ctx, email); err != nil {
+			slog.Error("failed to send password reset mail", "err", err)
+		}
+	}()
+	return nil
+}
+
+// sendPasswordReset creates a reset token for the account of email, if any,
+// and mails its link.
+func (s *Service) sendPasswordReset(ctx context.Context, email string) error {
+	u := repository.New(s.db).CheckUser(ctx, email)
+	if u == nil {
+		return nil
+	}
+
+	token, err := session.NewToken(ResetTokenPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = repository.New(s.db).CreatePasswordReset(ctx, repository.PasswordReset{
+		TokenHash: session.HashToken(token),
+		UserID:    u.ID,
+		ExpiresAt: time.Now().Add(s.cfg.ResetTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("error when creating reset token: %w", err)
+	}
+
+	link := s.cfg.BaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	err = s.cfg.Mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+			"If it was you, follow this link within %s:\n\n%s\n\n"+
+			"If it wasn't, you can ignore this message.\n", u.Name, s.cfg.ResetTTL, link),
+	})
+	if err != nil {
+		return fmt.Errorf("error when sending reset mail: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password using a reset token. The token and any
+// other outstanding token of the user are spent, and every session of the
+// user is revoked.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) error {
+	if err := s.cfg.PasswordPolicy.Check(password); err != nil {
+		return err
+	}
+
+	var userID int
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		reset := r.CheckPasswordReset(ctx, session.HashToken(token))
+		if reset == nil || reset.UsedAt != nil || !time.Now().Before(reset.ExpiresAt) {
+			return ErrInvalidReset
+		}
+		userID = reset.UserID
+
+		passwordHash, err := s.hashPassword(password)
+		if err != nil {
+			return fmt.Errorf("error when resetting password: %w", err)
+		}
+
+		if err := r.UpdateUserPassword(ctx, reset.UserID, passwordHash); err != nil {
+			return err
+		}
+		return r.UsePasswordResets(ctx, reset.UserID, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.sessions.RevokeAll(ctx, userID); err != nil {
+		return fmt.Errorf("error when revoking sessions: %w", err)
+	}
+	return nil
+}
+
+// ChangePassword replaces the password of user id after checking current.
+// Wrong current passwords count as failed logins and are locked out the same
+// way. Every other session of the user is revoked; sessionID, the session
+// making the change, stays logged in.
+func (s *Service) ChangePassword(ctx context.Context, id int, sessionID, current, password string, meta session.Meta) error {
+	if err := s.cfg.PasswordPolicy.Check(password); err != nil {
+		return err
+	}
+
+	var email string
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		email = u.Email
+		if err := s.checkLocked(ctx, accountKey(email), ipKey(meta.IP)); err != nil {
+			return err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(current)) != nil {
+			return ErrWrongPassword
+		}
+
+		passwordHash, err := s.hashPassword(password)
+		if err != nil {
+			return fmt.Errorf("error when changing password: %w", err)
+		}
+		return r.UpdateUserPassword(ctx, id, passwordHash)
+	})
+	if errors.Is(err, ErrWrongPassword) {
+		if err := s.loginFailed(ctx, email, meta); err != nil {
+			return err
+		}
+		return ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.sessions.List(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error when revoking sessions: %w", err)
+	}
+	for _, sess := range sessions {
+		if sess.ID == sessionID {
+			continue
+		}
+		if err := s.sessions.Revoke(ctx, id, sess.ID); err != nil {
+			return fmt.Errorf("error when revoking sessions: %w", err)
+		}
+	}
+	return nil
+}
+
+// hashPassword hashes password at the configured bcrypt cost.
+func (s *Service) hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cfg.PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// rehashPassword upgrades the stored hash of u to the configured cost after a
+// successful login with password. Failing to do so doesn't fail the login.
+func (s *Service) rehashPassword(ctx context.Context, u *repository.User, password string) {
+	cost, err := bcrypt.Cost([]byte(u.PasswordHash))
+	if err != nil || cost >= s.cfg.PasswordCost {
+		return
+	}
+
+	passwordHash, err := s.hashPassword(password)
+	if err == nil {
+		err = repository.New(s.db).UpdateUserPassword(ctx, u.ID, passwordHash)
+	}
+	if err != nil {
+		slog.Error("failed to rehash password", "user_id", u.ID, "err", err)
+	}
+}
+
+func (s *Service) HandleForgotPassword() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Email string `json:"email"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.ForgotPassword(r.Context(), input.Email, sessionMeta(r))
+		if errors.Is(err, ErrTooManyAttempts) {
+			loginErrorResponse(w, err)
+			return
+		}
+		// Other failures are logged rather than returned; the answer never
+		// depends on whether the address is registered.
+		if err != nil {
+			slog.Error("failed to start password reset", "err", err)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (s *Service) HandleResetPassword() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.ResetPassword(r.Context(), input.Token, input.Password)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) HandleChangePassword() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			CurrentPassword string `json:"current_password"`
+			Password        string `json:"password"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx := r.Context()
+		err = s.ChangePassword(ctx, IDFromContext(ctx), sessionIDFromContext(ctx), input.CurrentPassword, input.Password, sessionMeta(r))
+		switch {
+		case errors.Is(err, ErrTooManyAttempts):
+			loginErrorResponse(w, err)
+			return
+		case errors.Is(err, ErrWrongPassword):
+			server.ErrorResponse(w, http.StatusForbidden, err)
+			return
+		case errors.Is(err, ErrEmptyPassword), errors.Is(err, ErrWeakPassword):
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			return
+		case err != nil:
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,221 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/session"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	mailer := mail.NewMemoryMailer()
+	s, mock := newTestService(t, Config{Mailer: mailer})
+	ctx := context.Background()
+	queryReset := regexp.QuoteMeta("SELECT * FROM password_reset WHERE token_hash = ?")
+	resetColumns := []string{"token_hash", "user_id", "expires_at", "used_at"}
+
+	t.Run("unknown email", func(t *testing.T) {
+		mock.ExpectQuery(queryUserEmail).WithArgs("nobody@example.com").WillReturnRows(sqlmock.NewRows(userColumns))
+		if err := s.sendPasswordReset(ctx, "nobody@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(mailer.Sent()); n != 0 {
+			t.Fatalf("sent %d messages for an unknown email", n)
+		}
+	})
+
+	tokens, err := s.sessions.Create(ctx, 3, session.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(queryUserEmail).WithArgs("someone@example.com").WillReturnRows(userRow(3, "someone@example.com", nil))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO password_reset")).WithArgs(sqlmock.AnyArg(), 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.sendPasswordReset(ctx, "someone@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := mailedToken(t, mailer, "someone@example.com")
+	if !session.HasPrefix(token, ResetTokenPrefix) {
+		t.Fatalf("reset token %q without prefix %s", token, ResetTokenPrefix)
+	}
+
+	t.Run("weak password", func(t *testing.T) {
+		s.cfg.PasswordPolicy.MinLength = 12
+		defer func() { s.cfg.PasswordPolicy.MinLength = 0 }()
+		if err := s.ResetPassword(ctx, token, "short"); !errors.Is(err, ErrWeakPassword) {
+			t.Fatalf("err %v, want %v", err, ErrWeakPassword)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryReset).WithArgs(session.HashToken(token + "x")).WillReturnRows(sqlmock.NewRows(resetColumns))
+		mock.ExpectRollback()
+		if err := s.ResetPassword(ctx, token+"x", "a new password"); !errors.Is(err, ErrInvalidReset) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidReset)
+		}
+	})
+
+	t.Run("resets", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryReset).WithArgs(session.HashToken(token)).
+			WillReturnRows(sqlmock.NewRows(resetColumns).AddRow(session.HashToken(token), 3, time.Now().Add(time.Hour), nil))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET password_hash = ? WHERE id = ?")).WithArgs(sqlmock.AnyArg(), 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE password_reset SET used_at = ? WHERE user_id = ? AND used_at IS NULL")).
+			WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		if err := s.ResetPassword(ctx, token, "a new password"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.sessions.Validate(ctx, tokens.AccessToken); err == nil {
+			t.Error("session survived the reset")
+		}
+	})
+
+	t.Run("spent token", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryReset).WithArgs(session.HashToken(token)).
+			WillReturnRows(sqlmock.NewRows(resetColumns).AddRow(session.HashToken(token), 3, time.Now().Add(time.Hour), time.Now()))
+		mock.ExpectRollback()
+		if err := s.ResetPassword(ctx, token, "another password"); !errors.Is(err, ErrInvalidReset) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidReset)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleForgotPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "counts the request",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUnlocked(mock, "reset:email:someone@example.com", "reset:ip:192.0.2.1")
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryAttempt).WithArgs("reset:email:someone@example.com").
+					WillReturnRows(sqlmock.NewRows(attemptColumns).AddRow("reset:email:someone@example.com", 1, time.Now(), nil))
+				mock.ExpectExec(saveAttempt).WithArgs("reset:email:someone@example.com", 2, sqlmock.AnyArg(), nil).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+				expectFirstFailure(mock, "reset:ip:192.0.2.1")
+			},
+			status: http.StatusAccepted,
+		},
+		{
+			name: "locked email",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryAttempt).WithArgs("reset:email:someone@example.com").
+					WillReturnRows(sqlmock.NewRows(attemptColumns).AddRow("reset:email:someone@example.com", 3, time.Now(), time.Now().Add(time.Minute)))
+			},
+			status: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{Lockout: testLockout})
+			tt.expect(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/password/forgot", strings.NewReader(`{"email": "Someone@example.com"}`))
+			req.RemoteAddr = "192.0.2.1:1234"
+			rec := httptest.NewRecorder()
+			s.HandleForgotPassword()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestHandleChangePassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("current password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "email", "password_hash"}).AddRow(3, "someone@example.com", string(hash))
+	}
+
+	tests := []struct {
+		name    string
+		current string
+		expect  func(mock sqlmock.Sqlmock)
+		status  int
+	}{
+		{
+			name:    "changes",
+			current: "current password",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET password_hash = ? WHERE id = ?")).WithArgs(sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name:    "wrong password counts as a failed login",
+			current: "guess",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUnlocked(mock, "email:someone@example.com", "ip:192.0.2.1")
+				mock.ExpectRollback()
+				expectFirstFailure(mock, "email:someone@example.com", "ip:192.0.2.1")
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:    "locked account",
+			current: "current password",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(queryAttempt).WithArgs("email:someone@example.com").
+					WillReturnRows(sqlmock.NewRows(attemptColumns).AddRow("email:someone@example.com", 3, time.Now(), time.Now().Add(time.Minute)))
+				mock.ExpectRollback()
+			},
+			status: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{Lockout: testLockout})
+			mock.ExpectBegin()
+			mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account())
+			tt.expect(mock)
+
+			body := `{"current_password": "` + tt.current + `", "password": "a new password"}`
+			req := httptest.NewRequest(http.MethodPut, "/user/password", strings.NewReader(body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			req = req.WithContext(NewContext(req.Context(), 3, ""))
+			rec := httptest.NewRecorder()
+			s.HandleChangePassword()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package user
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// maxPasswordBytes is the most bcrypt hashes; longer passwords are refused
+// rather than silently truncated.
+const maxPasswordBytes = 72
+
+var (
+	ErrEmptyName    = errors.New("name can't be empty")
+	ErrWeakPassword = errors.New("password doesn't meet the password policy")
+)
+
+// PasswordPolicy is what a new password must satisfy.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lowercase, uppercase, digits and other
+	// characters the password must mix.
+	MinClasses int
+	// Denied holds lowercased passwords that are too common to allow.
+	Denied map[string]struct{}
+}
+
+// Check returns an error wrapping ErrWeakPassword describing the first rule
+// password breaks.
+func (p PasswordPolicy) Check(password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	if n := len([]rune(password)); n < p.MinLength {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: must be at most %d bytes", ErrWeakPassword, maxPasswordBytes)
+	}
+	if n := passwordClasses(password); n < p.MinClasses {
+		return fmt.Errorf("%w: must mix at least %d of lowercase, uppercase, digits and symbols", ErrWeakPassword, p.MinClasses)
+	}
+	if _, ok := p.Denied[strings.ToLower(password)]; ok {
+		return fmt.Errorf("%w: too common", ErrWeakPassword)
+	}
+	return nil
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// LoadDenyList reads common passwords from path, see ParseDenyList.
+func LoadDenyList(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseDenyList(f)
+}
+
+// ParseDenyList reads common passwords from r, one per line. Blank lines and
+// lines starting with # are skipped.
+func ParseDenyList(r io.Reader) (map[string]struct{}, error) {
+	denied := make(map[string]struct{})
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denied[strings.ToLower(line)] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return denied, nil
+}
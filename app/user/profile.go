@@ -0,0 +1,316 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTimezone = errors.New("unknown timezone")
+	ErrInvalidLocale   = errors.New("invalid locale")
+	ErrReauthRequired  = errors.New("log in with the identity provider again to confirm")
+)
+
+// reauthWindow is how long after logging in a session of an account without
+// a password may delete it. Such accounts were created through an identity
+// provider, so logging in again there is how the user confirms.
+const reauthWindow = 5 * time.Minute
+
+// localePattern loosely matches BCP 47 tags such as "en", "id-ID" or
+// "zh-Hant-TW".
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// maxLocaleLen is the width of the user.locale column.
+const maxLocaleLen = 35
+
+type Profile struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Verified   bool   `json:"verified"`
+	TOTP       bool   `json:"totp_enabled"`
+	Timezone   string `json:"timezone"`
+	Locale     string `json:"locale"`
+	Role       string `json:"role"`
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+	VerifiedAt string `json:"verified_at,omitempty"`
+	DisabledAt string `json:"disabled_at,omitempty"`
+}
+
+// ProfileParamUpdate holds the fields to change; nil fields are left as
+// they are. An empty timezone or locale clears it.
+type ProfileParamUpdate struct {
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Timezone *string `json:"timezone"`
+	Locale   *string `json:"locale"`
+}
+
+func (s *Service) GetProfile(ctx context.Context, id int) (Profile, error) {
+	u := repository.New(s.db).CheckUserByID(ctx, id)
+	if u == nil {
+		return Profile{}, fmt.Errorf("user %d %w", id, ErrNotFound)
+	}
+	return mapProfile(u), nil
+}
+
+// UpdateProfile applies params to user id. A new email is unverified until
+// the link mailed to it is followed.
+func (s *Service) UpdateProfile(ctx context.Context, id int, params ProfileParamUpdate) (Profile, error) {
+	var u *repository.User
+	var emailChanged bool
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u = r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+
+		if params.Name != nil {
+			name := strings.TrimSpace(*params.Name)
+			if name == "" {
+				return ErrEmptyName
+			}
+			u.Name = name
+		}
+
+		if params.Email != nil && *params.Email != u.Email {
+			email := *params.Email
+			addr, err := netmail.ParseAddress(email)
+			if err != nil || addr.Address != email {
+				return fmt.Errorf("email %s: %w", email, ErrInvalidEmail)
+			}
+			if r.CheckUser(ctx, email) != nil {
+				return fmt.Errorf("email %s %w", email, ErrAlreadyRegistered)
+			}
+			u.Email = email
+			u.VerifiedAt = nil
+			emailChanged = true
+		}
+
+		if params.Timezone != nil {
+			tz := *params.Timezone
+			if _, err := time.LoadLocation(tz); err != nil {
+				return fmt.Errorf("%w: %s", ErrInvalidTimezone, tz)
+			}
+			u.Timezone = optional(tz)
+		}
+
+		if params.Locale != nil {
+			locale := *params.Locale
+			if locale != "" && (len(locale) > maxLocaleLen || !localePattern.MatchString(locale)) {
+				return fmt.Errorf("%w: %s", ErrInvalidLocale, locale)
+			}
+			u.Locale = optional(locale)
+		}
+
+		err := r.UpdateUserProfile(ctx, *u)
+		if repository.IsDuplicate(err) {
+			return fmt.Errorf("email %s %w", u.Email, ErrAlreadyRegistered)
+		}
+		return err
+	})
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if emailChanged {
+		s.sendVerificationAsync(id)
+	}
+	return s.GetProfile(ctx, id)
+}
+
+// DeleteAccount soft-deletes user id, trashing the user's cards and
+// revoking every session and access token. The user confirms with the
+// password, see confirmUser.
+func (s *Service) DeleteAccount(ctx context.Context, id int, sessionID, password string) error {
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.CheckUserByID(ctx, id)
+		if u == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		if err := s.confirmUser(ctx, u, sessionID, password); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := r.DeleteUser(ctx, id, now); err != nil {
+			return err
+		}
+		if err := r.DeleteUserCards(ctx, id, now); err != nil {
+			return err
+		}
+		if err := r.DeleteUserAccessTokens(ctx, id); err != nil {
+			return err
+		}
+		return r.DeleteUserIdentities(ctx, id)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.sessions.RevokeAll(ctx, id); err != nil {
+		return fmt.Errorf("error when revoking sessions: %w", err)
+	}
+	return nil
+}
+
+// confirmUser checks that a sensitive change to u is made by its owner: with
+// the password, or for accounts without one, from sessionID having logged in
+// through the identity provider within reauthWindow.
+func (s *Service) confirmUser(ctx context.Context, u *repository.User, sessionID, password string) error {
+	if u.PasswordHash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return ErrWrongPassword
+		}
+		return nil
+	}
+
+	recent, err := s.recentLogin(ctx, u.ID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !recent {
+		return ErrReauthRequired
+	}
+	return nil
+}
+
+// recentLogin reports whether session sessionID of user id was logged in
+// within reauthWindow. Refreshing a session doesn't count as logging in, and
+// an account without a password can only log in through the provider.
+func (s *Service) recentLogin(ctx context.Context, id int, sessionID string) (bool, error) {
+	ss, err := s.sessions.List(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	for _, sess := range ss {
+		if sess.ID == sessionID {
+			return time.Since(sess.CreatedAt) < reauthWindow, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) HandleGetProfile() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.GetProfile(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+func (s *Service) HandleUpdateProfile() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var params ProfileParamUpdate
+
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		p, err := s.UpdateProfile(r.Context(), IDFromContext(r.Context()), params)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrAlreadyRegistered):
+				status = http.StatusConflict
+			case errors.Is(err, ErrEmptyName), errors.Is(err, ErrInvalidEmail),
+				errors.Is(err, ErrInvalidTimezone), errors.Is(err, ErrInvalidLocale):
+				status = http.StatusUnprocessableEntity
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+func (s *Service) HandleDeleteAccount() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Password string `json:"password"`
+		}
+
+		// Accounts without a password may leave the body out.
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil && !errors.Is(err, io.EOF) {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.DeleteAccount(r.Context(), IDFromContext(r.Context()), sessionIDFromContext(r.Context()), input.Password)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrWrongPassword), errors.Is(err, ErrReauthRequired):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func mapProfile(u *repository.User) Profile {
+	p := Profile{
+		ID:        u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Verified:  u.VerifiedAt != nil,
+		TOTP:      u.TOTPEnabledAt != nil,
+		Role:      u.Role,
+		CreatedAt: u.CreatedAt.Format(time.DateTime),
+		UpdatedAt: u.UpdatedAt.Format(time.DateTime),
+	}
+	if u.Timezone != nil {
+		p.Timezone = *u.Timezone
+	}
+	if u.Locale != nil {
+		p.Locale = *u.Locale
+	}
+	if u.VerifiedAt != nil {
+		p.VerifiedAt = u.VerifiedAt.Format(time.DateTime)
+	}
+	if u.DisabledAt != nil {
+		p.DisabledAt = u.DisabledAt.Format(time.DateTime)
+	}
+	return p
+}
+
+// optional returns nil for an empty v, for nullable columns.
+func optional(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
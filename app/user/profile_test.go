@@ -0,0 +1,171 @@
+package user
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/session"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleDeleteAccount(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("current password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDelete := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET deleted_at = ?")).WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE card SET deleted_at = ?")).WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM personal_access_token")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user_identity")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	account := func(passwordHash string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "email", "password_hash"}).AddRow(3, "someone@example.com", passwordHash)
+	}
+
+	tests := []struct {
+		name     string
+		loggedIn time.Duration
+		body     string
+		expect   func(mock sqlmock.Sqlmock)
+		status   int
+	}{
+		{
+			name:     "password",
+			loggedIn: time.Hour,
+			body:     `{"password": "current password"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(string(hash)))
+				expectDelete(mock)
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name:     "wrong password",
+			loggedIn: time.Minute,
+			body:     `{"password": "guess"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(string(hash)))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "no password just after logging in",
+			loggedIn: time.Minute,
+			body:     "",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(string(hash)))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "provider account just after logging in",
+			loggedIn: time.Minute,
+			body:     "",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(""))
+				expectDelete(mock)
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name:     "provider account logged in long ago",
+			loggedIn: time.Hour,
+			body:     `{}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(account(""))
+				mock.ExpectRollback()
+			},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+			store := session.NewMemoryStore()
+			s.sessions = session.NewManager(store, session.Config{AccessTTL: time.Minute, AbsoluteTTL: 24 * time.Hour})
+			now := time.Now()
+			err := store.Save(context.Background(), session.Session{
+				ID:              "current",
+				AccessHash:      "access",
+				RefreshHash:     "refresh",
+				UserID:          3,
+				CreatedAt:       now.Add(-tt.loggedIn),
+				LastSeenAt:      now,
+				AccessExpiresAt: now.Add(time.Minute),
+				ExpiresAt:       now.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.expect(mock)
+
+			req := httptest.NewRequest(http.MethodDelete, "/user/me", strings.NewReader(tt.body))
+			ctx := NewContext(req.Context(), 3, "")
+			req = req.WithContext(context.WithValue(ctx, sessionCtxKey{}, "current"))
+			rec := httptest.NewRecorder()
+			s.HandleDeleteAccount()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestHandleUpdateProfileLocale(t *testing.T) {
+	tests := []struct {
+		name   string
+		locale string
+		status int
+	}{
+		{name: "tag", locale: "zh-Hant-TW", status: http.StatusOK},
+		{name: "malformed", locale: "english", status: http.StatusUnprocessableEntity},
+		{name: "longer than the column", locale: "en" + strings.Repeat("-abcdefgh", 4), status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newTestService(t, Config{})
+			mock.ExpectBegin()
+			mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(userRow(3, "someone@example.com", nil))
+			if tt.status == http.StatusOK {
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET")).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(userRow(3, "someone@example.com", nil))
+			} else {
+				mock.ExpectRollback()
+			}
+
+			body := `{"locale": "` + tt.locale + `"}`
+			req := httptest.NewRequest(http.MethodPatch, "/user/me", strings.NewReader(body))
+			req = req.WithContext(NewContext(req.Context(), 3, ""))
+			rec := httptest.NewRecorder()
+			s.HandleUpdateProfile()(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Roles lists every role a user can have.
+var Roles = []string{RoleUser, RoleAdmin}
+
+var (
+	ErrForbiddenRole   = errors.New("not allowed for this role")
+	ErrAccountDisabled = errors.New("account disabled")
+	ErrUnknownRole     = errors.New("unknown role")
+)
+
+type roleCtxKey struct{}
+
+// RequireRole rejects users that don't have role or whose account is
+// disabled. It must run inside TokenMiddleware; handlers after it can read
+// the role with RoleFromContext.
+func (s *Service) RequireRole(role string, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := repository.New(s.db).CheckUserByID(r.Context(), IDFromContext(r.Context()))
+		switch {
+		case u == nil:
+			server.ErrorResponse(w, http.StatusForbidden, fmt.Errorf("role %s %w", role, ErrForbiddenRole))
+			return
+		case u.DisabledAt != nil:
+			server.ErrorResponse(w, http.StatusForbidden, ErrAccountDisabled)
+			return
+		case u.Role != role:
+			server.ErrorResponse(w, http.StatusForbidden, fmt.Errorf("role %s %w", u.Role, ErrForbiddenRole))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), roleCtxKey{}, u.Role)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RoleFromContext returns the role checked by RequireRole, or "" outside it.
+func RoleFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(roleCtxKey{}).(string)
+	return v
+}
+
+// GetUsers lists every account that isn't deleted, for admins.
+func (s *Service) GetUsers(ctx context.Context, page, size int) ([]Profile, int, error) {
+	us, total, err := repository.New(s.db).GetUsers(ctx, repository.PaginationParams{Page: page, Size: size})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res := make([]Profile, 0, len(us))
+	for _, u := range us {
+		res = append(res, mapProfile(&u))
+	}
+	return res, total, nil
+}
+
+// SetDisabled disables or re-enables user id. Disabling revokes every
+// session; personal access tokens are refused until re-enabled.
+func (s *Service) SetDisabled(ctx context.Context, id int, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	err := s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		if r.CheckUserByID(ctx, id) == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		return r.UpdateUserDisabled(ctx, id, disabledAt)
+	})
+	if err != nil {
+		return err
+	}
+
+	if disabled {
+		if err := s.sessions.RevokeAll(ctx, id); err != nil {
+			return fmt.Errorf("error when revoking sessions: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) SetRole(ctx context.Context, id int, role string) error {
+	if !slices.Contains(Roles, role) {
+		return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+	}
+
+	return s.execTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		if r.CheckUserByID(ctx, id) == nil {
+			return fmt.Errorf("user %d %w", id, ErrNotFound)
+		}
+		return r.UpdateUserRole(ctx, id, role)
+	})
+}
+
+func (s *Service) HandleGetUsers() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urlParams := r.URL.Query()
+		var errs []error
+
+		page := 1
+		if v := urlParams.Get("page"); v != "" {
+			var err error
+			page, err = strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		size := 10
+		if v := urlParams.Get("size"); v != "" {
+			var err error
+			size, err = strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) > 0 {
+			server.ErrorResponse(w, http.StatusBadRequest, errors.Join(errs...))
+			return
+		}
+
+		us, total, err := s.GetUsers(r.Context(), page, size)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		output := struct {
+			Total int
+			Data  []Profile
+		}{
+			Total: total,
+			Data:  us,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) HandleDisableUser() func(http.ResponseWriter, *http.Request) {
+	return s.handleSetDisabled(true)
+}
+
+func (s *Service) HandleEnableUser() func(http.ResponseWriter, *http.Request) {
+	return s.handleSetDisabled(false)
+}
+
+func (s *Service) handleSetDisabled(disabled bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		if disabled && id == IDFromContext(r.Context()) {
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, errors.New("can't disable your own account"))
+			return
+		}
+
+		err = s.SetDisabled(r.Context(), id, disabled)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) HandleSetRole() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var input struct {
+			Role string `json:"role"`
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.SetRole(r.Context(), id, input.Role)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrUnknownRole):
+				status = http.StatusUnprocessableEntity
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
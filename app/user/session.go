@@ -0,0 +1,186 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/jwt"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/session"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUserAgentLen matches the width of the session.user_agent column.
+const maxUserAgentLen = 255
+
+type Session struct {
+	ID         string `json:"id"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	CreatedAt  string `json:"created_at"`
+	LastSeenAt string `json:"last_seen_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"`
+}
+
+// Tokens is the body returned by login and refresh. Token holds the access
+// token under the name older clients already read.
+type Tokens struct {
+	AuthorID         int    `json:"author_id"`
+	Token            string `json:"token"`
+	TokenExpiresAt   string `json:"token_expires_at"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt string `json:"refresh_expires_at"`
+}
+
+func (s *Service) HandleRefresh() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		tokens, err := s.sessions.Refresh(r.Context(), input.RefreshToken)
+		if err == nil {
+			tokens, err = s.signAccessToken(tokens)
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, session.ErrNotFound),
+				errors.Is(err, session.ErrExpired),
+				errors.Is(err, session.ErrRefreshReused),
+				errors.Is(err, session.ErrNotRefreshToken):
+				status = http.StatusUnauthorized
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, mapTokens(tokens.UserID, tokens))
+	}
+}
+
+func (s *Service) HandleLogout() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.sessions.Revoke(r.Context(), IDFromContext(r.Context()), sessionIDFromContext(r.Context()))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) HandleLogoutAll() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.sessions.RevokeAll(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) HandleGetSessions() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ss, err := s.sessions.List(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		current := sessionIDFromContext(r.Context())
+		res := make([]Session, 0, len(ss))
+		for _, sess := range ss {
+			res = append(res, Session{
+				ID:         sess.ID,
+				IP:         sess.IP,
+				UserAgent:  sess.UserAgent,
+				CreatedAt:  sess.CreatedAt.Format(time.DateTime),
+				LastSeenAt: sess.LastSeenAt.Format(time.DateTime),
+				ExpiresAt:  sess.ExpiresAt.Format(time.DateTime),
+				Current:    sess.ID == current,
+			})
+		}
+
+		output := struct {
+			Total int
+			Data  []Session
+		}{
+			Total: len(res),
+			Data:  res,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) HandleDeleteSession() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.sessions.Revoke(r.Context(), IDFromContext(r.Context()), r.PathValue("id"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, session.ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// signAccessToken replaces the opaque access token with a JWT when the
+// service runs in JWT mode.
+func (s *Service) signAccessToken(tokens session.Tokens) (session.Tokens, error) {
+	if s.cfg.JWT == nil {
+		return tokens, nil
+	}
+
+	token, err := s.cfg.JWT.Sign(jwt.Claims{
+		Subject:   strconv.Itoa(tokens.UserID),
+		ExpiresAt: tokens.AccessExpiresAt.Unix(),
+		SessionID: tokens.SessionID,
+	})
+	if err != nil {
+		return session.Tokens{}, fmt.Errorf("error when signing access token: %w", err)
+	}
+	tokens.AccessToken = token
+	return tokens, nil
+}
+
+func mapTokens(authorID int, data session.Tokens) Tokens {
+	return Tokens{
+		AuthorID:         authorID,
+		Token:            data.AccessToken,
+		TokenExpiresAt:   data.AccessExpiresAt.Format(time.DateTime),
+		RefreshToken:     data.RefreshToken,
+		RefreshExpiresAt: data.RefreshExpiresAt.Format(time.DateTime),
+	}
+}
+
+func sessionMeta(r *http.Request) session.Meta {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLen {
+		ua = strings.ToValidUTF8(ua[:maxUserAgentLen], "")
+	}
+	return session.Meta{IP: ip, UserAgent: ua}
+}
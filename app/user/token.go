@@ -0,0 +1,239 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"github.com/febriW/be-to-do/session"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenPrefix marks personal access tokens so that they can be told apart
+// from session tokens and recognised by secret scanners.
+const TokenPrefix = "tdp_"
+
+const (
+	ScopeCardsRead  = "cards:read"
+	ScopeCardsWrite = "cards:write"
+)
+
+// Scopes lists every scope a personal access token can be granted.
+var Scopes = []string{ScopeCardsRead, ScopeCardsWrite}
+
+// maxTokenNameLen matches the width of the personal_access_token.name column.
+const maxTokenNameLen = 100
+
+type Token struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  string   `json:"expires_at"`
+	LastUsedAt string   `json:"last_used_at"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+type TokenParamCreate struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is optional; tokens without it never expire.
+	ExpiresAt string `json:"expires_at"`
+}
+
+// CreateToken issues a personal access token for userID and returns it with
+// its plain text value, which is not stored and can't be shown again.
+func (s *Service) CreateToken(ctx context.Context, userID int, params TokenParamCreate) (Token, string, error) {
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxTokenNameLen {
+		return Token{}, "", fmt.Errorf("token name must be 1 to %d characters: %w", maxTokenNameLen, ErrInvalidToken)
+	}
+
+	if len(params.Scopes) == 0 {
+		return Token{}, "", fmt.Errorf("token needs at least one scope: %w", ErrInvalidToken)
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return Token{}, "", fmt.Errorf("unknown scope %s: %w", scope, ErrInvalidToken)
+		}
+	}
+
+	var expiresAt *time.Time
+	if params.ExpiresAt != "" {
+		parsedTime, parseErr := time.Parse(time.DateTime, params.ExpiresAt)
+		if parseErr != nil {
+			return Token{}, "", fmt.Errorf("invalid date format for expires_at: %w", parseErr)
+		}
+		if !parsedTime.After(time.Now()) {
+			return Token{}, "", fmt.Errorf("expires_at must be in the future: %w", ErrInvalidToken)
+		}
+		expiresAt = &parsedTime
+	}
+
+	token, err := session.NewToken(TokenPrefix)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	repo := repository.New(s.db)
+	id, err := repo.CreateAccessToken(ctx, repository.AccessToken{
+		UserID:    userID,
+		Name:      params.Name,
+		TokenHash: session.HashToken(token),
+		Scopes:    strings.Join(params.Scopes, " "),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return Token{}, "", fmt.Errorf("error when creating token: %w", err)
+	}
+
+	t := repo.CheckAccessTokenByID(ctx, userID, id)
+	if t == nil {
+		return Token{}, "", fmt.Errorf("token %d %w", id, ErrNotFound)
+	}
+	return mapTokenRepoToService(*t), token, nil
+}
+
+func (s *Service) GetTokens(ctx context.Context, userID int) ([]Token, error) {
+	ts, err := repository.New(s.db).GetAccessTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Token, 0, len(ts))
+	for _, t := range ts {
+		res = append(res, mapTokenRepoToService(t))
+	}
+	return res, nil
+}
+
+func (s *Service) RevokeToken(ctx context.Context, userID, id int) error {
+	n, err := repository.New(s.db).DeleteAccessToken(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("token %d %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// validateToken looks up a personal access token and records its use.
+func (s *Service) validateToken(ctx context.Context, token string) (repository.AccessToken, error) {
+	repo := repository.New(s.db)
+	t := repo.CheckAccessToken(ctx, session.HashToken(token))
+	if t == nil {
+		return repository.AccessToken{}, ErrUnknownToken
+	}
+
+	now := time.Now()
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return repository.AccessToken{}, ErrTokenExpired
+	}
+
+	u := repo.CheckUserByID(ctx, t.UserID)
+	if u == nil {
+		return repository.AccessToken{}, ErrUnknownToken
+	}
+	if u.DisabledAt != nil {
+		return repository.AccessToken{}, ErrAccountDisabled
+	}
+
+	if err := repo.TouchAccessToken(ctx, t.ID, now); err != nil {
+		slog.Error("failed to record token use", "token_id", t.ID, "err", err)
+	}
+	return *t, nil
+}
+
+func (s *Service) HandleCreateToken() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input TokenParamCreate
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		t, token, err := s.CreateToken(r.Context(), IDFromContext(r.Context()), input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		output := struct {
+			Token
+			Value string `json:"token"`
+		}{
+			Token: t,
+			Value: token,
+		}
+		server.JSONResponse(w, http.StatusCreated, output)
+	}
+}
+
+func (s *Service) HandleGetTokens() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ts, err := s.GetTokens(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		output := struct {
+			Total int
+			Data  []Token
+		}{
+			Total: len(ts),
+			Data:  ts,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) HandleDeleteToken() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.RevokeToken(r.Context(), IDFromContext(r.Context()), id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func mapTokenRepoToService(data repository.AccessToken) Token {
+	var expiresAt string
+	if data.ExpiresAt != nil {
+		expiresAt = data.ExpiresAt.Format(time.DateTime)
+	}
+
+	var lastUsedAt string
+	if data.LastUsedAt != nil {
+		lastUsedAt = data.LastUsedAt.Format(time.DateTime)
+	}
+
+	return Token{
+		ID:         data.ID,
+		Name:       data.Name,
+		Scopes:     strings.Fields(data.Scopes),
+		ExpiresAt:  expiresAt,
+		LastUsedAt: lastUsedAt,
+		CreatedAt:  data.CreatedAt.Format(time.DateTime),
+	}
+}
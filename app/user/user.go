@@ -6,17 +6,30 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/febriW/be-to-do/jwt"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/oidc"
 	"github.com/febriW/be-to-do/repository"
 	"github.com/febriW/be-to-do/server"
 	"github.com/febriW/be-to-do/session"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
 )
 
 var (
 	ErrAlreadyRegistered = errors.New("account already registered")
-	ErrInvalidLogin      = errors.New("invalid login")
+	ErrInvalidLogin      = errors.New("invalid credentials")
 	ErrNotFound          = errors.New("not found")
+	ErrMissingToken      = errors.New("missing authorization token")
+	ErrUnknownToken      = errors.New("unknown access token")
+	ErrTokenExpired      = errors.New("access token expired")
+	ErrInvalidToken      = errors.New("invalid access token")
+	ErrInsufficientScope = errors.New("not granted to this token")
+	ErrSessionRequired   = errors.New("only available to a logged in session")
+	ErrInvalidEmail      = errors.New("invalid email address")
 )
 
 type User struct {
@@ -25,34 +38,93 @@ type User struct {
 	Password string `json:"password"`
 }
 
+type Config struct {
+	// JWT switches access tokens to signed JWTs. Sessions still back refresh
+	// tokens and logout, and a JWT stops working once its session is
+	// revoked. Nil keeps opaque tokens.
+	JWT *jwt.KeySet
+	// Mailer delivers password reset and verification mail.
+	Mailer mail.Mailer
+	// BaseURL is where links sent by mail point to.
+	BaseURL string
+	// ResetTTL is how long a password reset token stays usable.
+	ResetTTL time.Duration
+	// Secret signs verification links. It must be shared by every instance.
+	Secret []byte
+	// VerifyTTL is how long an email verification link stays usable.
+	VerifyTTL time.Duration
+	// RequireVerified makes RequireVerified reject unverified accounts.
+	RequireVerified bool
+	Lockout         LockoutPolicy
+	// AdminKey guards operator endpoints. Empty disables them.
+	AdminKey string
+	// OIDC enables login through an OpenID provider when set.
+	OIDC           *oidc.Provider
+	PasswordPolicy PasswordPolicy
+	// PasswordCost is the bcrypt cost of new hashes. Hashes of a lower cost
+	// are upgraded on the next login. Zero means bcrypt.DefaultCost.
+	PasswordCost int
+}
+
 type Service struct {
-	db *sql.DB
+	db       *sql.DB
+	sessions *session.Manager
+	cfg      Config
+	// dummyHash is compared against when the email is unknown, so that a
+	// login for a missing account costs the same time as a wrong password.
+	dummyHash []byte
 }
 
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+func NewService(db *sql.DB, sessions *session.Manager, cfg Config) *Service {
+	if cfg.PasswordCost == 0 {
+		cfg.PasswordCost = bcrypt.DefaultCost
+	}
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), cfg.PasswordCost)
+	return &Service{db: db, sessions: sessions, cfg: cfg, dummyHash: dummyHash}
 }
 
 func (s *Service) Register(ctx context.Context, name, email, password string) error {
-	err := s.execTx(ctx, func(r *repository.Repository) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrEmptyName
+	}
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("email %s: %w", email, ErrInvalidEmail)
+	}
+	if err := s.cfg.PasswordPolicy.Check(password); err != nil {
+		return err
+	}
+
+	var id int
+	err = s.execTx(ctx, func(r *repository.Repository) error {
 		u := r.CheckUser(ctx, email)
 		if u != nil {
 			return fmt.Errorf("email %s %w", email, ErrAlreadyRegistered)
 		}
 
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		passwordHash, err := s.hashPassword(password)
 		if err != nil {
 			return fmt.Errorf("error when registered: %w", err)
 		}
 
-		return r.CreateUser(ctx, repository.User{
+		id, err = r.CreateUser(ctx, repository.User{
 			Name:         name,
 			Email:        email,
-			PasswordHash: string(passwordHash),
+			PasswordHash: passwordHash,
 		})
+		// Addresses of deleted accounts stay taken.
+		if repository.IsDuplicate(err) {
+			return fmt.Errorf("email %s %w", email, ErrAlreadyRegistered)
+		}
+		return err
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.sendVerificationAsync(id)
+	return nil
 }
 
 func (s *Service) HandleRegister() func(w http.ResponseWriter, r *http.Request) {
@@ -79,20 +151,60 @@ func (s *Service) HandleRegister() func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func (s *Service) Login(ctx context.Context, email, password string) (int, string, error) {
+// LoginResult is either a started session or, for accounts with two-factor
+// authentication, a challenge to complete with LoginMFA.
+type LoginResult struct {
+	AuthorID int
+	Tokens   session.Tokens
+	// MFAToken is set instead of Tokens when a second factor is required.
+	MFAToken string
+}
+
+// Login checks the credentials and starts a session. Unknown emails and
+// wrong passwords both return ErrInvalidLogin after the same amount of work,
+// and repeated failures per email and per client IP lock further attempts.
+func (s *Service) Login(ctx context.Context, email, password string, meta session.Meta) (LoginResult, error) {
+	if err := s.checkLocked(ctx, accountKey(email), ipKey(meta.IP)); err != nil {
+		return LoginResult{}, err
+	}
+
 	repo := repository.New(s.db)
 	u := repo.CheckUser(ctx, email)
-	if u == nil {
-		return 0, "", fmt.Errorf("user with email %s: %w", email, ErrNotFound)
+
+	// Accounts without a password, created through the identity provider,
+	// get the dummy hash too so they take as long to refuse.
+	hash := s.dummyHash
+	if u != nil && u.PasswordHash != "" {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || u == nil || u.PasswordHash == "" {
+		if err := s.loginFailed(ctx, email, meta); err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{}, ErrInvalidLogin
+	}
+
+	if err := repo.DeleteLoginAttempt(ctx, accountKey(email)); err != nil {
+		return LoginResult{}, fmt.Errorf("error when clearing failed logins: %w", err)
 	}
+	s.rehashPassword(ctx, u, password)
 
-	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
-		return 0, "", fmt.Errorf("user password not match: %w", ErrInvalidLogin)
+	if u.DisabledAt != nil {
+		return LoginResult{}, ErrAccountDisabled
 	}
 
-	authorID := u.ID
-	token := session.Create(u.ID)
-	return authorID, token, nil
+	if u.TOTPEnabledAt != nil {
+		return LoginResult{
+			AuthorID: u.ID,
+			MFAToken: s.sign(purposeMFA, u.ID, u.Email, time.Now().Add(mfaChallengeTTL)),
+		}, nil
+	}
+
+	tokens, err := s.startSession(ctx, u.ID, meta)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{AuthorID: u.ID, Tokens: tokens}, nil
 }
 
 func (s *Service) HandleLogin() func(w http.ResponseWriter, r *http.Request) {
@@ -108,37 +220,58 @@ func (s *Service) HandleLogin() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		authorID, token, err := s.Login(r.Context(), input.Email, input.Password)
+		res, err := s.Login(r.Context(), input.Email, input.Password, sessionMeta(r))
 		if err != nil {
-			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			loginErrorResponse(w, err)
 			return
 		}
 
-		output := struct {
-			AuthorID int    `json:"author_id"`
-			Token    string `json:"token"`
-		}{
-			AuthorID: authorID,
-			Token:    token,
+		if res.MFAToken != "" {
+			output := struct {
+				MFARequired bool   `json:"mfa_required"`
+				MFAToken    string `json:"mfa_token"`
+			}{
+				MFARequired: true,
+				MFAToken:    res.MFAToken,
+			}
+			server.JSONResponse(w, http.StatusOK, output)
+			return
 		}
 
-		server.JSONResponse(w, http.StatusOK, output)
+		server.JSONResponse(w, http.StatusOK, mapTokens(res.AuthorID, res.Tokens))
 	}
 }
 
-func (s *Service) execTx(ctx context.Context, fn func(*repository.Repository) error) error {
-	tx, err := s.db.BeginTx(ctx, nil)
+// startSession creates a session for a user who has fully authenticated,
+// unless the account is disabled.
+func (s *Service) startSession(ctx context.Context, id int, meta session.Meta) (session.Tokens, error) {
+	u := repository.New(s.db).CheckUserByID(ctx, id)
+	if u == nil {
+		return session.Tokens{}, fmt.Errorf("user %d %w", id, ErrNotFound)
+	}
+	if u.DisabledAt != nil {
+		return session.Tokens{}, ErrAccountDisabled
+	}
+
+	tokens, err := s.sessions.Create(ctx, id, meta)
 	if err != nil {
-		return err
+		return session.Tokens{}, fmt.Errorf("error when creating session: %w", err)
 	}
-	repo := repository.New(tx)
-	err = fn(repo)
+	return s.signAccessToken(tokens)
+}
+
+// loginFailed counts a failed login against the email and the client IP.
+func (s *Service) loginFailed(ctx context.Context, email string, meta session.Meta) error {
+	err := errors.Join(
+		s.recordFailure(ctx, accountKey(email), s.cfg.Lockout.MaxAccountAttempts),
+		s.recordFailure(ctx, ipKey(meta.IP), s.cfg.Lockout.MaxIPAttempts),
+	)
 	if err != nil {
-		if rbErr := tx.Rollback(); rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
-		}
-		return err
+		return fmt.Errorf("error when recording failed login: %w", err)
 	}
+	return nil
+}
 
-	return tx.Commit()
+func (s *Service) execTx(ctx context.Context, fn func(*repository.Repository) error) error {
+	return repository.ExecTx(ctx, s.db, fn)
 }
@@ -0,0 +1,105 @@
+package user
+
+import (
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/session"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryUserEmail = regexp.QuoteMeta("FROM user WHERE email = ?")
+	queryUserID    = regexp.QuoteMeta("FROM user WHERE id = ?")
+	userColumns    = []string{"id", "name", "email", "password_hash", "verified_at", "totp_enabled_at", "role", "disabled_at", "deleted_at"}
+	queryAttempt   = regexp.QuoteMeta("SELECT * FROM login_attempt WHERE attempt_key = ?")
+	saveAttempt    = regexp.QuoteMeta("INSERT INTO login_attempt ")
+	attemptColumns = []string{"attempt_key", "failures", "last_failed_at", "locked_until"}
+	testLockout    = LockoutPolicy{MaxAccountAttempts: 3, MaxIPAttempts: 10, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+)
+
+// newTestService returns a service on a mocked database with in-memory
+// sessions and mail. Unset durations, the secret and the mailer get test
+// defaults.
+func newTestService(t *testing.T, cfg Config) (*Service, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if cfg.Secret == nil {
+		cfg.Secret = []byte("test secret")
+	}
+	if cfg.Mailer == nil {
+		cfg.Mailer = mail.NewMemoryMailer()
+	}
+	if cfg.ResetTTL == 0 {
+		cfg.ResetTTL = time.Hour
+	}
+	if cfg.VerifyTTL == 0 {
+		cfg.VerifyTTL = time.Hour
+	}
+	cfg.BaseURL = "http://app.test"
+	cfg.PasswordCost = bcrypt.MinCost
+
+	sessions := session.NewManager(session.NewMemoryStore(), session.Config{
+		AccessTTL:   time.Minute,
+		AbsoluteTTL: time.Hour,
+	})
+	return NewService(db, sessions, cfg), mock
+}
+
+func userRow(id int, email string, verifiedAt *time.Time) *sqlmock.Rows {
+	var verified driver.Value
+	if verifiedAt != nil {
+		verified = *verifiedAt
+	}
+	return sqlmock.NewRows(userColumns).AddRow(id, "Someone", email, "hash", verified, nil, "user", nil, nil)
+}
+
+// mailedToken returns the token of the link in the only message sent.
+func mailedToken(t *testing.T, mailer *mail.MemoryMailer, to string) string {
+	t.Helper()
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if sent[0].To != to {
+		t.Errorf("mail to %s, want %s", sent[0].To, to)
+	}
+	m := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(sent[0].Body)
+	if m == nil {
+		t.Fatalf("no link in %q", sent[0].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// expectUnlocked expects checkLocked to find no attempts for keys.
+func expectUnlocked(mock sqlmock.Sqlmock, keys ...string) {
+	for _, key := range keys {
+		mock.ExpectQuery(queryAttempt).WithArgs(key).WillReturnRows(sqlmock.NewRows(attemptColumns))
+	}
+}
+
+// expectFirstFailure expects recordFailure to count the first failure of
+// each of keys.
+func expectFirstFailure(mock sqlmock.Sqlmock, keys ...string) {
+	for _, key := range keys {
+		mock.ExpectBegin()
+		mock.ExpectQuery(queryAttempt).WithArgs(key).WillReturnRows(sqlmock.NewRows(attemptColumns))
+		mock.ExpectExec(saveAttempt).WithArgs(key, 1, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+}
@@ -0,0 +1,132 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/febriW/be-to-do/mail"
+	"github.com/febriW/be-to-do/repository"
+	"github.com/febriW/be-to-do/server"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const purposeVerify = "verify-email"
+
+var (
+	ErrAlreadyVerified = errors.New("email already verified")
+	ErrNotVerified     = errors.New("email address not verified")
+)
+
+// SendVerification mails a link confirming the current email of user id.
+func (s *Service) SendVerification(ctx context.Context, id int) error {
+	u := repository.New(s.db).CheckUserByID(ctx, id)
+	if u == nil {
+		return fmt.Errorf("user %d %w", id, ErrNotFound)
+	}
+	if u.VerifiedAt != nil {
+		return ErrAlreadyVerified
+	}
+
+	// The email is part of the token, so links sent to a previous address
+	// stop working once the address changes.
+	token := s.sign(purposeVerify, u.ID, u.Email, time.Now().Add(s.cfg.VerifyTTL))
+	link := s.cfg.BaseURL + "/user/verify?token=" + url.QueryEscape(token)
+	err := s.cfg.Mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by following this link within %s:\n\n%s\n",
+			u.Name, s.cfg.VerifyTTL, link),
+	})
+	if err != nil {
+		return fmt.Errorf("error when sending verification mail: %w", err)
+	}
+	return nil
+}
+
+// VerifyEmail marks the email carried by token as verified.
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	id, email, err := s.verifySigned(purposeVerify, token, time.Now())
+	if err != nil {
+		return err
+	}
+
+	n, err := repository.New(s.db).VerifyUser(ctx, id, email, time.Now())
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// RequireVerified rejects users whose email isn't verified when the service
+// is configured to, and passes every request otherwise. It must run inside
+// TokenMiddleware.
+func (s *Service) RequireVerified(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.RequireVerified {
+			next(w, r)
+			return
+		}
+
+		u := repository.New(s.db).CheckUserByID(r.Context(), IDFromContext(r.Context()))
+		if u == nil || u.VerifiedAt == nil {
+			server.ErrorResponse(w, http.StatusForbidden, ErrNotVerified)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Service) HandleVerifyEmail() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.VerifyEmail(r.Context(), r.URL.Query().Get("token"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidSignature) {
+				status = http.StatusBadRequest
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			Verified bool `json:"verified"`
+		}{
+			Verified: true,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) HandleResendVerification() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.SendVerification(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrAlreadyVerified) {
+				status = http.StatusConflict
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// sendVerificationAsync is used where a failed mail must not fail the
+// request that triggered it.
+func (s *Service) sendVerificationAsync(id int) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.SendVerification(ctx, id); err != nil {
+			slog.Error("failed to send verification mail", "user_id", id, "err", err)
+		}
+	}()
+}
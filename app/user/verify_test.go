@@ -0,0 +1,57 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/febriW/be-to-do/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailVerification(t *testing.T) {
+	mailer := mail.NewMemoryMailer()
+	s, mock := newTestService(t, Config{Mailer: mailer})
+	ctx := context.Background()
+	verify := regexp.QuoteMeta("UPDATE user SET verified_at = COALESCE(verified_at, ?) WHERE id = ? AND email = ?")
+
+	mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(userRow(3, "someone@example.com", nil))
+	if err := s.SendVerification(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	token := mailedToken(t, mailer, "someone@example.com")
+
+	t.Run("tampered link", func(t *testing.T) {
+		if err := s.VerifyEmail(ctx, strings.Replace(token, ".", "x.", 1)); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidSignature)
+		}
+	})
+
+	t.Run("link for a changed address", func(t *testing.T) {
+		mock.ExpectExec(verify).WithArgs(sqlmock.AnyArg(), 3, "someone@example.com").WillReturnResult(sqlmock.NewResult(0, 0))
+		if err := s.VerifyEmail(ctx, token); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("err %v, want %v", err, ErrInvalidSignature)
+		}
+	})
+
+	t.Run("verifies", func(t *testing.T) {
+		mock.ExpectExec(verify).WithArgs(sqlmock.AnyArg(), 3, "someone@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+		if err := s.VerifyEmail(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("already verified", func(t *testing.T) {
+		verifiedAt := time.Now()
+		mock.ExpectQuery(queryUserID).WithArgs(3).WillReturnRows(userRow(3, "someone@example.com", &verifiedAt))
+		if err := s.SendVerification(ctx, 3); !errors.Is(err, ErrAlreadyVerified) {
+			t.Fatalf("err %v, want %v", err, ErrAlreadyVerified)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
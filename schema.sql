@@ -3,18 +3,125 @@ CREATE TABLE user (
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
+    verified_at TIMESTAMP NULL,
+    totp_secret VARCHAR(64) NULL,
+    totp_enabled_at TIMESTAMP NULL,
+    totp_last_step BIGINT NULL,
+    timezone VARCHAR(64) NULL,
+    locale VARCHAR(35) NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'user',
+    disabled_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP NULL
 );
 
 CREATE TABLE card (
-    activities_no VARCHAR(10) NOT NULL PRIMARY KEY,
+    activities_no VARCHAR(64) NOT NULL PRIMARY KEY,
     author_id INT NOT NULL,
     title VARCHAR(100) NOT NULL,
     content TEXT  NOT NULL,
-    marked_status VARCHAR(10) NULL,
+    marked_status VARCHAR(32) NULL,
     marked TIMESTAMP NULL,
+    status_changed_at TIMESTAMP NULL,
+    version INT UNSIGNED NOT NULL DEFAULT 1,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     deleted_at TIMESTAMP NULL
-);
\ No newline at end of file
+);
+
+CREATE TABLE session (
+    id CHAR(32) NOT NULL PRIMARY KEY,
+    access_hash CHAR(64) NOT NULL UNIQUE,
+    refresh_hash CHAR(64) NOT NULL UNIQUE,
+    user_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP NOT NULL,
+    access_expires_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    INDEX idx_session_user_id (user_id),
+    INDEX idx_session_expires_at (expires_at)
+);
+
+CREATE TABLE session_rotated_token (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    session_id CHAR(32) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    rotated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (session_id) REFERENCES session (id) ON DELETE CASCADE
+);
+
+CREATE TABLE personal_access_token (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_personal_access_token_user_id (user_id)
+);
+
+CREATE TABLE password_reset (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_password_reset_user_id (user_id)
+);
+
+CREATE TABLE login_attempt (
+    attempt_key VARCHAR(300) NOT NULL PRIMARY KEY,
+    failures INT UNSIGNED NOT NULL,
+    last_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP NULL
+);
+
+CREATE TABLE recovery_code (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_recovery_code_user_code (user_id, code_hash)
+);
+
+CREATE TABLE user_identity (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_user_identity_issuer_subject (issuer, subject),
+    INDEX idx_user_identity_user_id (user_id)
+);
+
+CREATE TABLE card_sequence (
+    scope VARCHAR(50) NOT NULL PRIMARY KEY,
+    last_value BIGINT UNSIGNED NOT NULL
+);
+
+CREATE TABLE card_status (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    name VARCHAR(32) NOT NULL,
+    base VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_card_status_user_id_name (user_id, name)
+);
+
+CREATE TABLE card_reopen (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    activities_no VARCHAR(64) NOT NULL,
+    reopened_by INT UNSIGNED NOT NULL,
+    reason VARCHAR(500) NOT NULL,
+    from_status VARCHAR(32) NOT NULL,
+    to_status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_card_reopen_activities_no (activities_no)
+);